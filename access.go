@@ -0,0 +1,56 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"sort"
+)
+
+// An item along with its access count at the time it was collected.
+type accessedItem struct {
+	item  *RegommendItem
+	count int64
+}
+
+// A list of accessedItems, sortable by descending access count, ties broken
+// by the string form of the keys.
+type accessedItemList []accessedItem
+
+func (p accessedItemList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p accessedItemList) Len() int      { return len(p) }
+func (p accessedItemList) Less(i, j int) bool {
+	if p[i].count != p[j].count {
+		return p[i].count > p[j].count
+	}
+
+	return keyString(p[i].item.key) < keyString(p[j].item.key)
+}
+
+// Returns the n most accessed items, or all of them if n is zero or
+// negative, the most accessed first, see RegommendItem.AccessCount. Useful
+// to find the items worth precomputing recommendations for.
+func (table *RegommendTable) MostAccessed(n int) []*RegommendItem {
+	table.RLock()
+	items := make(accessedItemList, 0, len(table.items))
+	for _, item := range table.items {
+		items = append(items, accessedItem{item, item.AccessCount()})
+	}
+	table.RUnlock()
+
+	sort.Sort(items)
+	if n > 0 && len(items) > n {
+		items = items[:n]
+	}
+
+	r := make([]*RegommendItem, len(items))
+	for i, a := range items {
+		r[i] = a.item
+	}
+
+	return r
+}
@@ -0,0 +1,51 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+// How the scores of neighbors get combined into a recommendation's score.
+type Aggregation int
+
+const (
+	// Averages the neighbors' scores, weighted by their similarity. Only
+	// neighbors who scored a data key count, so the result predicts the
+	// score itself, no matter how many neighbors scored it.
+	WeightedAverage Aggregation = iota
+	// Sums up the neighbors' scores, each weighted by the neighbor's share
+	// of the total similarity. Favors data keys scored by many neighbors.
+	WeightedSum
+)
+
+// Selects how the scores of neighbors get combined when recommending, see
+// Aggregation. Defaults to WeightedAverage.
+func (table *RegommendTable) SetAggregation(a Aggregation) {
+	table.Lock()
+	defer table.Unlock()
+	table.aggregation = a
+}
+
+// Returns how much the scores of a neighbor count, given the sum of all
+// neighbors' similarities. Neighbors weighing zero or less are skipped.
+// Callers must hold the table lock.
+func (table *RegommendTable) weight(v DistancePair, totalDistance float64, opts *recommendOptions) float64 {
+	weight := v.Distance
+	if table.aggregation != WeightedAverage {
+		if totalDistance <= 0 {
+			// no neighbor is similar at all
+			return 0
+		}
+		weight = v.Distance / totalDistance
+		if weight > 1 {
+			weight = 1
+		}
+	}
+
+	if opts.significanceCap > 0 && v.overlap < opts.significanceCap {
+		weight *= float64(v.overlap) / float64(opts.significanceCap)
+	}
+	return weight
+}
@@ -0,0 +1,241 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"sync/atomic"
+)
+
+// Returns an independent copy of the table with the given name, holding
+// copies of all items and the same configuration, including callbacks.
+// Changes to either table don't affect the other one. Like New, the copy
+// doesn't get registered with an engine.
+func (table *RegommendTable) Clone(name string) *RegommendTable {
+	table.RLock()
+	defer table.RUnlock()
+
+	clone := &RegommendTable{
+		id:                  newTableID(),
+		name:                name,
+		items:               make(map[interface{}]*RegommendItem, len(table.items)),
+		logger:              table.logger,
+		verbose:             table.verbose,
+		aggregation:         table.aggregation,
+		similarity:          table.similarity,
+		assumeNormalized:    table.assumeNormalized,
+		simCacheSize:        table.simCacheSize,
+		shrinkage:           table.shrinkage,
+		minOverlap:          table.minOverlap,
+		decay:               table.decay,
+		workers:             table.workers,
+		fallbackMin:         table.fallbackMin,
+		defaultTTL:          table.defaultTTL,
+		loadData:            table.loadData,
+		addedItem:           table.addedItem,
+		addedItemFilter:     table.addedItemFilter,
+		aboutToDeleteItem:   table.aboutToDeleteItem,
+		aboutToDeleteFilter: table.aboutToDeleteFilter,
+		expiredItem:         table.expiredItem,
+	}
+	if table.simCache != nil {
+		clone.simCache = newSimilarityCache(table.simCache.size)
+	}
+
+	expires := false
+	for k, item := range table.items {
+		clone.items[k] = item.clone()
+		if item.lifeSpan > 0 {
+			expires = true
+		}
+	}
+	clone.rebuildPopularity()
+	clone.ttl = table.ttl
+	if table.ttl > 0 || expires {
+		clone.scheduleExpiration()
+	}
+
+	return clone
+}
+
+// Imports all items of other into the table. Data of items existing in both
+// tables gets merged like AddOrUpdate does, all other items get added. See
+// MergeWith.
+func (table *RegommendTable) Merge(other *RegommendTable) {
+	table.MergeWith(other, MergeUnion)
+}
+
+// Resolves the conflicting data of an item existing in both tables when
+// merging them, see MergeWith. Must return new data instead of modifying
+// either map.
+type MergeResolver func(existing, incoming map[interface{}]float64) map[interface{}]float64
+
+// Keeps all scores of both items, preferring incoming ones for data keys
+// both of them scored.
+func MergeUnion(existing, incoming map[interface{}]float64) map[interface{}]float64 {
+	merged := make(map[interface{}]float64, len(existing)+len(incoming))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range incoming {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// Replaces the existing item's data with the incoming one.
+func MergeOverwrite(existing, incoming map[interface{}]float64) map[interface{}]float64 {
+	merged := make(map[interface{}]float64, len(incoming))
+	for k, v := range incoming {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// Keeps all scores of both items, summing them up for data keys both of
+// them scored, e.g. for counts collected by different workers.
+func MergeSum(existing, incoming map[interface{}]float64) map[interface{}]float64 {
+	merged := make(map[interface{}]float64, len(existing)+len(incoming))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range incoming {
+		merged[k] += v
+	}
+
+	return merged
+}
+
+// Imports all items of other into the table. Items existing in both tables
+// get the data returned by onConflict, all other items get added. Both
+// tables are locked while merging, so other is merged as a consistent
+// snapshot, and onConflict must not call methods of either one. The
+// added-item filter gets asked about each new item before, without holding
+// any lock, and the added-item callback gets triggered for each new item.
+func (table *RegommendTable) MergeWith(other *RegommendTable, onConflict MergeResolver) {
+	if other == table {
+		return
+	}
+
+	// The new items, nil for the ones rejected by the added-item filter.
+	candidates := make(map[interface{}]*RegommendItem)
+	for {
+		lockBoth(table, other)
+		addedItemFilter := table.addedItemFilter
+		if addedItemFilter == nil {
+			break
+		}
+
+		pending := []*RegommendItem{}
+		for key, item := range other.items {
+			if _, ok := table.items[key]; ok {
+				continue
+			}
+			if _, ok := candidates[key]; !ok {
+				pending = append(pending, table.mergedItem(key, item))
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		// New items may show up meanwhile, asking about those next round.
+		other.RUnlock()
+		table.Unlock()
+		for _, n := range pending {
+			candidates[n.key] = nil
+			if addedItemFilter(n) {
+				candidates[n.key] = n
+			}
+		}
+	}
+
+	added := []*RegommendItem{}
+	for key, item := range other.items {
+		data := item.Data()
+		r, ok := table.items[key]
+		if ok {
+			old := r.Data()
+			r.replace(onConflict(old, data))
+			table.trackPopularity(old, r.Data())
+			table.invalidateSimilarities(key)
+			continue
+		}
+
+		n, ok := candidates[key]
+		if !ok {
+			n = table.mergedItem(key, item)
+		} else if n == nil {
+			// rejected
+			continue
+		}
+		table.trackPopularity(nil, n.data)
+		table.items[key] = n
+		table.invalidateSimilarities(key)
+		table.added(n)
+		added = append(added, n)
+	}
+	table.changed()
+	addedItem := table.addedItem
+
+	other.RUnlock()
+	table.Unlock()
+
+	if addedItem != nil {
+		for _, item := range added {
+			addedItem(item)
+		}
+	}
+}
+
+// The ID last assigned to a table, see newTableID.
+var lastTableID uint64
+
+// Returns a new ID, unique among all tables.
+func newTableID() uint64 {
+	return atomic.AddUint64(&lastTableID, 1)
+}
+
+// Returns the table's ID, assigning one first if the table wasn't created
+// by New or Clone.
+func (table *RegommendTable) tableID() uint64 {
+	if id := atomic.LoadUint64(&table.id); id != 0 {
+		return id
+	}
+	atomic.CompareAndSwapUint64(&table.id, 0, newTableID())
+	return atomic.LoadUint64(&table.id)
+}
+
+// Locks table for writing and other for reading, always in the same order
+// of their IDs, so merging them into each other concurrently can't
+// deadlock.
+func lockBoth(table, other *RegommendTable) {
+	if table.tableID() < other.tableID() {
+		table.Lock()
+		other.RLock()
+	} else {
+		other.RLock()
+		table.Lock()
+	}
+}
+
+// Returns a new item for the table with a copy of item's data and metadata,
+// see MergeWith. Callers must hold the table lock.
+func (table *RegommendTable) mergedItem(key interface{}, item *RegommendItem) *RegommendItem {
+	data := item.Data()
+	copied := make(map[interface{}]float64, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+	n := CreateRegommendItem(key, copied)
+	n.lifeSpan = table.defaultTTL
+	n.meta = item.Metadata()
+
+	return &n
+}
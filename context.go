@@ -0,0 +1,59 @@
+//go:build go1.7
+// +build go1.7
+
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"context"
+)
+
+// Like Value, but gives up once ctx is done. A data-loader that is already
+// running can't be interrupted, it finishes in the background and its item
+// still gets added to the engine.
+func (table *RegommendTable) ValueCtx(ctx context.Context, key interface{}) (*RegommendItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		item *RegommendItem
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		item, err := table.Value(key)
+		c <- result{item, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.item, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Like Recommend, but gives up and returns ctx.Err() once ctx is done, even
+// in the middle of computing similarities.
+func (table *RegommendTable) RecommendCtx(ctx context.Context, key interface{}, n int, opts ...RecommendOption) (RecommendationList, error) {
+	sitem, err := table.ValueCtx(ctx, key)
+	if err != nil {
+		return RecommendationList{}, err
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	recs, ok := table.recommend(key, sitem.Data(), n, newRecommendOptions(opts), ctx.Done())
+	if !ok {
+		return RecommendationList{}, ctx.Err()
+	}
+
+	return recs, nil
+}
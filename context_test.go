@@ -0,0 +1,64 @@
+//go:build go1.7
+// +build go1.7
+
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecommendCtx(t *testing.T) {
+	books := Table("recommendctx")
+	books.Add("Chris", map[interface{}]float64{"a": 4.0, "b": 3.0})
+	books.Add("Jay", map[interface{}]float64{"a": 4.0, "b": 3.0, "c": 5.0})
+
+	recs, err := books.RecommendCtx(context.Background(), "Chris", 0)
+	if err != nil || len(recs) != 1 || recs[0].Key != "c" {
+		t.Error("Unexpected recommendations", recs, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := books.RecommendCtx(ctx, "Chris", 0); err != context.Canceled {
+		t.Error("Expected context.Canceled, got", err)
+	}
+
+	// cancel while the similarity loop is running
+	ctx, cancel = context.WithCancel(context.Background())
+	books.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		cancel()
+		return 1.0
+	})
+	books.Add("Mary", map[interface{}]float64{"a": 1.0})
+	if _, err := books.RecommendCtx(ctx, "Chris", 0); err != context.Canceled {
+		t.Error("Expected context.Canceled from within the loop, got", err)
+	}
+}
+
+func TestValueCtx(t *testing.T) {
+	books := Table("valuectx")
+	books.SetDataLoader(func(key interface{}) *RegommendItem {
+		time.Sleep(time.Second)
+		item := CreateRegommendItem(key, map[interface{}]float64{"a": 1.0})
+		return &item
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := books.ValueCtx(ctx, "Chris"); err != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded, got", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Expected ValueCtx to return early")
+	}
+}
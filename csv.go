@@ -0,0 +1,159 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Loads items from CSV rows like userId,itemId,rating. Rows are grouped by
+// the value in column keyCol, which becomes the item's key. The score is
+// read from column valueCol, the data key from the first remaining column.
+// Columns are numbered from 0, keys and data keys are stored as strings.
+// A first row without a valid score is taken for a header and skipped.
+// Returns an error for negative or identical columns. Every key is added
+// once all its rows are read, replacing an existing item with the same key.
+func (table *RegommendTable) LoadFromCSV(r io.Reader, keyCol, valueCol int) error {
+	items, order, err := readCSV(r, keyCol, valueCol)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range order {
+		table.Add(key, items[key])
+	}
+
+	return nil
+}
+
+// Loads items from key,dataKey,value CSV rows, like the ones written by
+// SaveCSV. Works like LoadFromCSV, but merges the data into existing items
+// with the same key instead of replacing them, see AddOrUpdate.
+func (table *RegommendTable) LoadCSV(r io.Reader) error {
+	items, order, err := readCSV(r, 0, 2)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range order {
+		table.AddOrUpdate(key, items[key])
+	}
+
+	return nil
+}
+
+// Reads CSV rows into data maps grouped by key, see LoadFromCSV. Also
+// returns the keys in the order they first appeared in.
+func readCSV(r io.Reader, keyCol, valueCol int) (map[interface{}]map[interface{}]float64, []interface{}, error) {
+	if keyCol < 0 || valueCol < 0 {
+		return nil, nil, fmt.Errorf("Invalid columns %d and %d: columns are numbered from 0", keyCol, valueCol)
+	}
+	if keyCol == valueCol {
+		return nil, nil, fmt.Errorf("Invalid columns: key and score can't both be read from column %d", keyCol)
+	}
+
+	dataCol := 0
+	for dataCol == keyCol || dataCol == valueCol {
+		dataCol++
+	}
+	columns := dataCol
+	if keyCol > columns {
+		columns = keyCol
+	}
+	if valueCol > columns {
+		columns = valueCol
+	}
+	columns++
+
+	items := make(map[interface{}]map[interface{}]float64)
+	order := []interface{}{}
+
+	reader := csv.NewReader(r)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(record) < columns {
+			return nil, nil, fmt.Errorf("Line %d: expected at least %d columns, got %d", line, columns, len(record))
+		}
+		value, err := strconv.ParseFloat(record[valueCol], 64)
+		if err != nil {
+			if line == 1 {
+				// header row
+				continue
+			}
+			return nil, nil, fmt.Errorf("Line %d: invalid score %q", line, record[valueCol])
+		}
+
+		key := record[keyCol]
+		data, ok := items[key]
+		if !ok {
+			data = make(map[interface{}]float64)
+			items[key] = data
+			order = append(order, key)
+		}
+		data[record[dataCol]] = value
+	}
+
+	return items, order, nil
+}
+
+// Writes all items as CSV to w, one key,dataKey,value row per data entry
+// following a header row. Rows are sorted by key and data key. The table is
+// only locked while collecting its items, not while writing them. The result
+// can be read back using LoadCSV.
+func (table *RegommendTable) SaveCSV(w io.Writer) error {
+	table.RLock()
+	items := make(map[interface{}]*RegommendItem, len(table.items))
+	keys := make(byKey, 0, len(table.items))
+	for k, item := range table.items {
+		items[k] = item
+		keys = append(keys, k)
+	}
+	table.RUnlock()
+	sort.Sort(keys)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"key", "dataKey", "value"}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		data := items[k].Data()
+		dataKeys := make(byKey, 0, len(data))
+		for dk := range data {
+			dataKeys = append(dataKeys, dk)
+		}
+		sort.Sort(dataKeys)
+
+		for _, dk := range dataKeys {
+			row := []string{fmt.Sprint(k), fmt.Sprint(dk), strconv.FormatFloat(data[dk], 'g', -1, 64)}
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// Writes all items as CSV to w, see SaveCSV.
+//
+// Deprecated: Use SaveCSV, which pairs with LoadCSV.
+func (table *RegommendTable) DumpToCSV(w io.Writer) error {
+	return table.SaveCSV(w)
+}
@@ -0,0 +1,104 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Lets old scores count less than recent ones. Each score with a timestamp,
+// see RateAt, gets multiplied by exp(-age/halfLife), both when computing
+// similarities and when aggregating neighbors' scores into recommendations.
+// Scores without a timestamp keep counting fully. Zero or less disables
+// decay, which is the default. While enabled, similarities don't get cached
+// and the cached norms of SetAssumeNormalized aren't used, as decayed scores
+// change over time.
+func (table *RegommendTable) SetDecay(halfLife time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.decay = halfLife
+}
+
+// Stores score for dataKey in the item with the given key, along with the
+// time it was given at, see SetDecay. A missing item gets created with just
+// this one score. Returns an error if score isn't a finite number,
+// ErrAddCanceled if the added-item filter rejected the new item.
+func (table *RegommendTable) RateAt(key interface{}, dataKey interface{}, score float64, at time.Time) error {
+	if math.IsNaN(score) || math.IsInf(score, 0) {
+		return errors.New("Invalid rating")
+	}
+
+	table.Lock()
+	r, ok := table.items[key]
+	if ok {
+		old := r.Data()
+		r.rate(dataKey, score, at)
+		table.trackPopularity(old, r.Data())
+		table.changed()
+		table.invalidateSimilarities(key)
+		table.Unlock()
+		return nil
+	}
+
+	item := CreateRegommendItem(key, map[interface{}]float64{dataKey: score})
+	item.ratedOn = map[interface{}]time.Time{dataKey: at}
+	item.lifeSpan = table.defaultTTL
+	if admitted, released := table.admit(&item); !admitted {
+		table.Unlock()
+		return ErrAddCanceled
+	} else if released {
+		if _, ok := table.items[key]; ok {
+			// added meanwhile, rate that one
+			table.Unlock()
+			return table.RateAt(key, dataKey, score, at)
+		}
+	}
+	table.trackPopularity(nil, item.data)
+	table.items[key] = &item
+	table.changed()
+	table.added(&item)
+	addedItem := table.addedItem
+	table.Unlock()
+
+	if addedItem != nil {
+		addedItem(&item)
+	}
+
+	return nil
+}
+
+// Returns the data of item as of now, decayed as configured by SetDecay.
+// Callers must hold the table lock.
+func (table *RegommendTable) decayed(item *RegommendItem, now time.Time) map[interface{}]float64 {
+	if table.decay <= 0 {
+		return item.Data()
+	}
+
+	item.RLock()
+	defer item.RUnlock()
+	if len(item.ratedOn) == 0 {
+		return item.data
+	}
+
+	data := make(map[interface{}]float64, len(item.data))
+	for k, x := range item.data {
+		if at, ok := item.ratedOn[k]; ok {
+			age := now.Sub(at)
+			if age < 0 {
+				// rated in the future, don't boost it
+				age = 0
+			}
+			x *= math.Exp(-float64(age) / float64(table.decay))
+		}
+		data[k] = x
+	}
+
+	return data
+}
@@ -0,0 +1,79 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+// How many candidates per recommendation get considered when diversifying.
+const diversifyCandidates = 5
+
+// Returns how many of the best candidates to keep around for returning n
+// recommendations.
+func (o *recommendOptions) candidates(n int) int {
+	if o.diversity != 0 {
+		return n * diversifyCandidates
+	}
+
+	return n
+}
+
+// Picks n of the given recommendations, sorted by score, using maximal
+// marginal relevance, see Diversify. Picks all of them if n is zero or
+// negative. Callers must hold the table lock.
+func (table *RegommendTable) diversify(recs RecommendationList, n int, lambda float64) RecommendationList {
+	if n <= 0 || n > len(recs) {
+		n = len(recs)
+	}
+	if n < 2 {
+		return recs[:n]
+	}
+	columns, means := table.transpose()
+
+	// Scores scaled to [0, 1], so lambda doesn't depend on their scale.
+	max := recs[0].Score
+	min := recs[len(recs)-1].Score
+	relevance := make([]float64, len(recs))
+	for i, r := range recs {
+		relevance[i] = 1
+		if max != min {
+			relevance[i] = (r.Score - min) / (max - min)
+		}
+	}
+
+	// The highest similarity of each candidate to those picked already.
+	similarity := make([]float64, len(recs))
+	picked := make([]bool, len(recs))
+	diversified := make(RecommendationList, 0, n)
+	last := -1
+	for len(diversified) < n {
+		best := -1
+		bestValue := 0.0
+		for i := range recs {
+			if picked[i] {
+				continue
+			}
+			if last >= 0 {
+				sim := adjustedCosineSim(columns[recs[i].Key], columns[recs[last].Key], means)
+				if len(diversified) == 1 || sim > similarity[i] {
+					similarity[i] = sim
+				}
+			}
+
+			value := relevance[i] - lambda*similarity[i]
+			// ties go to the better score, as recs is sorted
+			if best < 0 || value > bestValue {
+				best = i
+				bestValue = value
+			}
+		}
+
+		picked[best] = true
+		diversified = append(diversified, recs[best])
+		last = best
+	}
+
+	return diversified
+}
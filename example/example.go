@@ -26,8 +26,8 @@ func main() {
 		fmt.Println("Recommending", nb.Key, "with score:", nb.Distance)
 	}
 
-	recs, _ := books.Recommend("Chris")
+	recs, _ := books.Recommend("Chris", 10)
 	for _, rec := range recs {
-		fmt.Println("Recommending", rec.Key, "with score:", rec.Distance)
+		fmt.Println("Recommending", rec.Key, "with score:", rec.Score)
 	}
 }
@@ -0,0 +1,197 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"time"
+)
+
+// Removes items which haven't been accessed for the given duration, unless
+// they were added with a TTL of their own. A background goroutine removes
+// expired items, see SetExpiredItemCallback. A duration of zero or less
+// disables the table-wide TTL, see also StopTTL.
+func (table *RegommendTable) SetTTL(d time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.ttl = d
+	if d > 0 || table.ttlStop != nil {
+		table.scheduleExpiration()
+	}
+}
+
+// Configures the TTL given to items added afterwards without one, see
+// AddWithTTL. Zero or less, the default, adds items without a TTL.
+func (table *RegommendTable) SetDefaultTTL(d time.Duration) {
+	table.Lock()
+	defer table.Unlock()
+	table.defaultTTL = d
+}
+
+// Disables the table-wide TTL and stops the background goroutine removing
+// expired items, waiting for it to exit. Adding another item with a TTL
+// starts it again.
+func (table *RegommendTable) StopTTL() {
+	table.Lock()
+	stop, done := table.ttlStop, table.ttlDone
+	table.ttl = 0
+	table.ttlStop, table.ttlDone, table.ttlWake = nil, nil, nil
+	table.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Records an item just added to the table, no matter by which method, and
+// makes sure it expires in time. Callers must hold the table lock.
+func (table *RegommendTable) added(item *RegommendItem) {
+	table.count("add")
+
+	// Items expiring due to the table-wide TTL never expire before the loop
+	// wakes up again anyway.
+	if item.lifeSpan > 0 {
+		table.scheduleExpiration()
+	}
+}
+
+// Starts the expiration loop unless it's running already, otherwise wakes
+// it up to reconsider when the next item expires. Callers must hold the
+// table lock.
+func (table *RegommendTable) scheduleExpiration() {
+	if table.ttlStop == nil {
+		table.ttlStop = make(chan struct{})
+		table.ttlDone = make(chan struct{})
+		table.ttlWake = make(chan struct{}, 1)
+		go table.expirationLoop(table.ttlStop, table.ttlDone, table.ttlWake)
+		return
+	}
+
+	select {
+	case table.ttlWake <- struct{}{}:
+	default:
+		// already about to wake up
+	}
+}
+
+// Removes expired items until stop gets closed, sleeping until the next
+// item expires in between.
+func (table *RegommendTable) expirationLoop(stop, done, wake chan struct{}) {
+	defer close(done)
+
+	for {
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if next := table.expire(); next > 0 {
+			timer = time.NewTimer(next)
+			expired = timer.C
+		}
+
+		select {
+		case <-stop:
+		case <-wake:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// Removes all expired items. Returns how long until the next check is due,
+// zero if there's nothing that could expire.
+func (table *RegommendTable) expire() time.Duration {
+	now := time.Now()
+	expired := []*RegommendItem{}
+	next := time.Duration(0)
+
+	// Checking and removing under the same lock, so items can't get
+	// touched, re-added or flushed in between.
+	table.Lock()
+	for key, r := range table.items {
+		left, ok := table.timeLeft(r, now)
+		if !ok {
+			continue
+		}
+		if left <= 0 {
+			delete(table.items, key)
+			table.trackPopularity(r.Data(), nil)
+			table.invalidateSimilarities(key)
+			r.resetAccess()
+			expired = append(expired, r)
+			continue
+		}
+		if next == 0 || left < next {
+			next = left
+		}
+	}
+	if len(expired) > 0 {
+		table.changed()
+		table.count("expire")
+		table.log("Expired items", "items", len(expired))
+	}
+	// Items added later on may expire due to the table-wide TTL, too.
+	if next == 0 || (table.ttl > 0 && table.ttl < next) {
+		next = table.ttl
+	}
+	expiredItem := table.expiredItem
+	table.Unlock()
+
+	if expiredItem != nil {
+		for _, r := range expired {
+			expiredItem(r)
+		}
+	}
+
+	return next
+}
+
+// Returns how long the item has left until it expires, false if it never
+// does. Callers must hold the table lock.
+func (table *RegommendTable) timeLeft(r *RegommendItem, now time.Time) (time.Duration, bool) {
+	lifeSpan := r.lifeSpan
+	if lifeSpan <= 0 {
+		lifeSpan = table.ttl
+	}
+	if lifeSpan <= 0 {
+		return 0, false
+	}
+
+	return lifeSpan - now.Sub(r.AccessedOn()), true
+}
+
+// Reports whether the item expired, even if the expiration loop didn't
+// remove it yet. Callers must hold the table lock.
+func (table *RegommendTable) expired(r *RegommendItem, now time.Time) bool {
+	left, ok := table.timeLeft(r, now)
+	return ok && left <= 0
+}
+
+// Resets the expiration loop after the table got flushed: with a table-wide
+// TTL it reconsiders when to wake up next, otherwise there's nothing left
+// to expire and it stops. Callers must hold the table lock.
+func (table *RegommendTable) resetExpiration() {
+	if table.ttlStop == nil {
+		return
+	}
+	if table.ttl > 0 {
+		table.scheduleExpiration()
+		return
+	}
+
+	// Can't wait for the loop to exit while holding the lock it may be
+	// waiting for, it exits on its own right after.
+	close(table.ttlStop)
+	table.ttlStop, table.ttlDone, table.ttlWake = nil, nil, nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"sort"
+)
+
+// How many contributors an ExplainedRecommendation lists by default.
+const defaultExplainLimit = 3
+
+// Limits how many contributors RecommendExplained lists per recommendation,
+// only keeping the ones contributing the most. Zero or less lists all of
+// them. Defaults to 3.
+func ExplainLimit(n int) RecommendOption {
+	return func(o *recommendOptions) {
+		o.explainLimit = n
+	}
+}
+
+// A neighbor that contributed to a recommendation.
+type Contributor struct {
+	// The neighbor's key.
+	Key interface{}
+	// The neighbor's similarity to the key a query was made for.
+	Similarity float64
+	// The neighbor's score for the recommended data key.
+	Score float64
+	// How much the neighbor added to the recommendation's raw score.
+	Contribution float64
+}
+
+// A list of Contributors, sortable by descending contribution.
+type ContributorList []Contributor
+
+func (p ContributorList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p ContributorList) Len() int      { return len(p) }
+func (p ContributorList) Less(i, j int) bool {
+	if p[i].Contribution != p[j].Contribution {
+		return p[i].Contribution > p[j].Contribution
+	}
+
+	return keyString(p[i].Key) < keyString(p[j].Key)
+}
+
+// A recommendation along with the neighbors contributing the most to it.
+type ExplainedRecommendation struct {
+	Recommendation
+	Contributors ContributorList
+}
+
+// Like Recommend, but explains each recommendation by listing the neighbors
+// contributing the most to its score, see ExplainLimit. Contributors get
+// collected while aggregating the scores, yet this is more expensive than
+// Recommend.
+func (table *RegommendTable) RecommendExplained(key interface{}, n int, opts ...RecommendOption) ([]ExplainedRecommendation, error) {
+	sitem, err := table.Value(key)
+	if err != nil {
+		return []ExplainedRecommendation{}, err
+	}
+	smap := sitem.Data()
+
+	table.RLock()
+	defer table.RUnlock()
+
+	o := newRecommendOptions(opts).forItem(sitem)
+	contributors := make(map[interface{}]ContributorList)
+	dists, _ := table.neighbors(key, smap, 0, o.significanceCap > 0, nil)
+	recs, _ := table.recommendFrom(dists, smap, n, o, contributors, nil)
+
+	explained := make([]ExplainedRecommendation, len(recs))
+	for i, r := range recs {
+		// empty for recommendations made for their popularity only
+		c := contributors[r.Key]
+		sort.Sort(c)
+		if o.explainLimit > 0 && len(c) > o.explainLimit {
+			c = c[:o.explainLimit]
+		}
+
+		explained[i] = ExplainedRecommendation{
+			Recommendation: r,
+			Contributors:   c,
+		}
+	}
+
+	return explained, nil
+}
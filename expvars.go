@@ -0,0 +1,89 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Serializes registering expvars, so two tables can't both find a
+	// name unpublished and then publish it.
+	expvarMutex sync.Mutex
+)
+
+// The expvars published for a table, see RegisterExpvars.
+type tableVars struct {
+	// Total time spent computing similarities and how many were computed,
+	// accessed atomically. Come first to be 64-bit aligned on 32-bit
+	// platforms.
+	similarityNanos int64
+	similarities    int64
+
+	items      *expvar.Int
+	similarity *expvar.Float
+	ops        *expvar.Map
+}
+
+// Publishes the table's metrics via expvar, so they show up on
+// /debug/vars: the number of items as namespace.items, the average time
+// it took to compute a similarity in seconds as namespace.similarity_seconds
+// and how often each operation was performed as namespace.ops. They get
+// updated on each operation. Returns an error if any of these names was
+// published already, as expvar doesn't allow publishing a name twice.
+func (table *RegommendTable) RegisterExpvars(namespace string) error {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+
+	names := []string{namespace + ".items", namespace + ".similarity_seconds", namespace + ".ops"}
+	for _, name := range names {
+		if expvar.Get(name) != nil {
+			return errors.New("Expvar already published: " + name)
+		}
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	vars := &tableVars{
+		items:      expvar.NewInt(names[0]),
+		similarity: expvar.NewFloat(names[1]),
+		ops:        expvar.NewMap(names[2]),
+	}
+	vars.items.Set(int64(len(table.items)))
+	table.vars = vars
+
+	return nil
+}
+
+// Records a change to the items. Callers must hold the table lock.
+func (table *RegommendTable) changed() {
+	table.version++
+	if table.vars != nil {
+		table.vars.items.Set(int64(len(table.items)))
+	}
+}
+
+// Counts an operation performed on the table. Callers must hold the table
+// lock.
+func (table *RegommendTable) count(op string) {
+	if table.vars != nil {
+		table.vars.ops.Add(op, 1)
+	}
+}
+
+// Records how long computing a similarity took. It's safe to call
+// concurrently.
+func (vars *tableVars) similarityTook(d time.Duration) {
+	nanos := atomic.AddInt64(&vars.similarityNanos, int64(d))
+	n := atomic.AddInt64(&vars.similarities, 1)
+	vars.similarity.Set(time.Duration(nanos / n).Seconds())
+}
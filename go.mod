@@ -0,0 +1,3 @@
+module github.com/muesli/regommend
+
+go 1.18
@@ -0,0 +1,143 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Gob representation of a table.
+type gobTable struct {
+	Name  string
+	Items []gobItem
+}
+
+// Gob representation of an item, with its data sorted by key.
+type gobItem struct {
+	Key  interface{}
+	Data []gobEntry
+	Meta map[string]interface{}
+}
+
+// Gob representation of a single data entry of an item.
+type gobEntry struct {
+	Key   interface{}
+	Value float64
+}
+
+// Sorts keys by their type and string form, which gives a deterministic
+// order for keys of any type.
+type byKey []interface{}
+
+func (p byKey) Len() int      { return len(p) }
+func (p byKey) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byKey) Less(i, j int) bool {
+	ti, tj := fmt.Sprintf("%T", p[i]), fmt.Sprintf("%T", p[j])
+	if ti != tj {
+		return ti < tj
+	}
+
+	return fmt.Sprint(p[i]) < fmt.Sprint(p[j])
+}
+
+// Encodes the table's name and items using encoding/gob. Items and their
+// data are sorted by key, so equal tables produce equal encodings. Keys,
+// data keys and metadata values are stored as interface values, so any
+// concrete type other than the basic ones like string, int or float64 needs
+// to be registered with gob.Register before encoding or decoding.
+func (table *RegommendTable) GobEncode() ([]byte, error) {
+	table.RLock()
+	t := gobTable{
+		Name:  table.name,
+		Items: make([]gobItem, 0, len(table.items)),
+	}
+	keys := make(byKey, 0, len(table.items))
+	for k := range table.items {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+
+	for _, k := range keys {
+		data := table.items[k].Data()
+		dataKeys := make(byKey, 0, len(data))
+		for dk := range data {
+			dataKeys = append(dataKeys, dk)
+		}
+		sort.Sort(dataKeys)
+
+		item := gobItem{
+			Key:  k,
+			Data: make([]gobEntry, len(dataKeys)),
+			Meta: table.items[k].Metadata(),
+		}
+		for i, dk := range dataKeys {
+			item.Data[i] = gobEntry{Key: dk, Value: data[dk]}
+		}
+		t.Items = append(t.Items, item)
+	}
+	table.RUnlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(t); err != nil {
+		return nil, errors.New("Could not encode table: " + err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Replaces all items of the table with the ones encoded by GobEncode. No
+// callbacks get triggered. The stored name is only taken over by tables
+// without a name. The table stays untouched if decoding fails.
+func (table *RegommendTable) GobDecode(b []byte) error {
+	var t gobTable
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&t); err != nil {
+		return errors.New("Could not decode table: " + err.Error())
+	}
+
+	items := make(map[interface{}]*RegommendItem, len(t.Items))
+	for _, i := range t.Items {
+		data := make(map[interface{}]float64, len(i.Data))
+		for _, e := range i.Data {
+			data[e.Key] = e.Value
+		}
+		item := CreateRegommendItem(i.Key, data)
+		item.meta = i.Meta
+		items[i.Key] = &item
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	if table.name == "" {
+		table.name = t.Name
+	}
+	for _, r := range table.items {
+		r.resetAccess()
+	}
+	table.items = items
+	table.rebuildPopularity()
+	table.changed()
+	table.clearSimilarities()
+
+	return nil
+}
+
+// Writes all items of this table to w, see GobEncode.
+func (table *RegommendTable) SaveToWriter(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(table)
+}
+
+// Replaces all items of this table with the ones read from r, as written
+// by SaveToWriter. See GobDecode.
+func (table *RegommendTable) LoadFromWriter(r io.Reader) error {
+	return gob.NewDecoder(r).Decode(table)
+}
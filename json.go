@@ -0,0 +1,340 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// JSON representation of a table.
+type jsonTable struct {
+	Name  string                            `json:"name"`
+	Items map[string]map[string]float64     `json:"items"`
+	Meta  map[string]map[string]interface{} `json:"meta,omitempty"`
+}
+
+// Encodes the table as {"name": ..., "items": {key: {dataKey: value}}},
+// along with {"meta": {key: {name: value}}} for items with metadata. Since
+// JSON objects only have string keys, this fails if any key or data key
+// isn't a string. Metadata values get decoded like encoding/json decodes
+// into an interface{}, e.g. numbers become float64s.
+func (table *RegommendTable) MarshalJSON() ([]byte, error) {
+	table.RLock()
+	defer table.RUnlock()
+
+	t := jsonTable{
+		Name:  table.name,
+		Items: make(map[string]map[string]float64, len(table.items)),
+	}
+	for k, item := range table.items {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("Key %v is not a string", k)
+		}
+
+		data := make(map[string]float64, len(item.Data()))
+		for dk, v := range item.Data() {
+			dataKey, ok := dk.(string)
+			if !ok {
+				return nil, fmt.Errorf("Data key %v of key %s is not a string", dk, key)
+			}
+			data[dataKey] = v
+		}
+		t.Items[key] = data
+		if meta := item.Metadata(); meta != nil {
+			if t.Meta == nil {
+				t.Meta = make(map[string]map[string]interface{})
+			}
+			t.Meta[key] = meta
+		}
+	}
+
+	return json.Marshal(t)
+}
+
+// Adds the items from JSON as produced by MarshalJSON to the table. Items
+// with the same key as an existing item replace it, all other existing items
+// are kept. The table name stored in the JSON is ignored.
+func (table *RegommendTable) LoadJSON(data []byte) error {
+	var t jsonTable
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+
+	for key, d := range t.Items {
+		item := table.Add(key, itemData(d))
+		if item == nil {
+			// rejected by the added-item filter
+			continue
+		}
+		for k, v := range t.Meta[key] {
+			item.SetMeta(k, v)
+		}
+	}
+
+	return nil
+}
+
+// Replaces all items of the table with the ones from JSON as produced by
+// MarshalJSON. Unlike LoadJSON, existing items not contained in the JSON
+// are removed and no callbacks get triggered. The stored name is only
+// taken over by tables without a name.
+func (table *RegommendTable) UnmarshalJSON(data []byte) error {
+	var t jsonTable
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+
+	items := make(map[interface{}]*RegommendItem, len(t.Items))
+	for key, d := range t.Items {
+		item := CreateRegommendItem(key, itemData(d))
+		item.meta = t.Meta[key]
+		items[key] = &item
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	if table.name == "" {
+		table.name = t.Name
+	}
+	for _, r := range table.items {
+		r.resetAccess()
+	}
+	table.items = items
+	table.rebuildPopularity()
+	table.changed()
+	table.clearSimilarities()
+
+	return nil
+}
+
+// Writes the table as JSON to the file at path, see MarshalJSON.
+func (table *RegommendTable) SaveToFile(path string) error {
+	data, err := table.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Replaces all items of the table with the ones stored in the file at path
+// by SaveToFile, see UnmarshalJSON.
+func (table *RegommendTable) LoadFromFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return table.UnmarshalJSON(data)
+}
+
+// Converts the data of an item decoded from a jsonTable.
+func itemData(d map[string]float64) map[interface{}]float64 {
+	data := make(map[interface{}]float64, len(d))
+	for dataKey, v := range d {
+		data[dataKey] = v
+	}
+
+	return data
+}
+
+// JSON representation of a key along with its type, so it can be decoded
+// to the same type again.
+type jsonKey struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// JSON representation of a single data entry of an item.
+type jsonEntry struct {
+	Key   jsonKey `json:"key"`
+	Value float64 `json:"value"`
+}
+
+// JSON representation of an item.
+type jsonItem struct {
+	Key  jsonKey                `json:"key"`
+	Data []jsonEntry            `json:"data"`
+	Meta map[string]interface{} `json:"meta,omitempty"`
+}
+
+// Encodes a key along with its type. Supports strings, booleans and all
+// integer and floating point types.
+func encodeKey(k interface{}) (jsonKey, error) {
+	var t string
+	switch k.(type) {
+	case string:
+		t = "string"
+	case bool:
+		t = "bool"
+	case int:
+		t = "int"
+	case int8:
+		t = "int8"
+	case int16:
+		t = "int16"
+	case int32:
+		t = "int32"
+	case int64:
+		t = "int64"
+	case uint:
+		t = "uint"
+	case uint8:
+		t = "uint8"
+	case uint16:
+		t = "uint16"
+	case uint32:
+		t = "uint32"
+	case uint64:
+		t = "uint64"
+	case float32:
+		t = "float32"
+	case float64:
+		t = "float64"
+	default:
+		return jsonKey{}, fmt.Errorf("Key %v has unsupported type %T", k, k)
+	}
+
+	v, err := json.Marshal(k)
+	if err != nil {
+		return jsonKey{}, err
+	}
+
+	return jsonKey{Type: t, Value: v}, nil
+}
+
+// Decodes a key encoded by encodeKey back to its original type.
+func decodeKey(k jsonKey) (interface{}, error) {
+	switch k.Type {
+	case "string":
+		var s string
+		err := json.Unmarshal(k.Value, &s)
+		return s, err
+	case "bool":
+		var b bool
+		err := json.Unmarshal(k.Value, &b)
+		return b, err
+	}
+
+	var n json.Number
+	d := json.NewDecoder(bytes.NewReader(k.Value))
+	d.UseNumber()
+	if err := d.Decode(&n); err != nil {
+		return nil, err
+	}
+	s := n.String()
+
+	switch k.Type {
+	case "int":
+		v, err := strconv.ParseInt(s, 10, 0)
+		return int(v), err
+	case "int8":
+		v, err := strconv.ParseInt(s, 10, 8)
+		return int8(v), err
+	case "int16":
+		v, err := strconv.ParseInt(s, 10, 16)
+		return int16(v), err
+	case "int32":
+		v, err := strconv.ParseInt(s, 10, 32)
+		return int32(v), err
+	case "int64":
+		v, err := strconv.ParseInt(s, 10, 64)
+		return v, err
+	case "uint":
+		v, err := strconv.ParseUint(s, 10, 0)
+		return uint(v), err
+	case "uint8":
+		v, err := strconv.ParseUint(s, 10, 8)
+		return uint8(v), err
+	case "uint16":
+		v, err := strconv.ParseUint(s, 10, 16)
+		return uint16(v), err
+	case "uint32":
+		v, err := strconv.ParseUint(s, 10, 32)
+		return uint32(v), err
+	case "uint64":
+		v, err := strconv.ParseUint(s, 10, 64)
+		return v, err
+	case "float32":
+		v, err := strconv.ParseFloat(s, 32)
+		return float32(v), err
+	case "float64":
+		v, err := strconv.ParseFloat(s, 64)
+		return v, err
+	}
+
+	return nil, fmt.Errorf("Unsupported key type %s", k.Type)
+}
+
+// Encodes the item's key, data and metadata. Keys and data keys are stored
+// along with their type, so they decode to the same type again. Supports
+// strings, booleans and all integer and floating point types as keys.
+// Metadata values get decoded like encoding/json decodes into an
+// interface{}, e.g. numbers become float64s.
+func (item *RegommendItem) MarshalJSON() ([]byte, error) {
+	item.RLock()
+	defer item.RUnlock()
+
+	key, err := encodeKey(item.key)
+	if err != nil {
+		return nil, err
+	}
+
+	i := jsonItem{
+		Key:  key,
+		Data: make([]jsonEntry, 0, len(item.data)),
+		Meta: item.Metadata(),
+	}
+	for k, v := range item.data {
+		dk, err := encodeKey(k)
+		if err != nil {
+			return nil, err
+		}
+		i.Data = append(i.Data, jsonEntry{Key: dk, Value: v})
+	}
+
+	return json.Marshal(i)
+}
+
+// Decodes an item encoded by MarshalJSON, replacing its key, data and
+// metadata.
+func (item *RegommendItem) UnmarshalJSON(b []byte) error {
+	var i jsonItem
+	if err := json.Unmarshal(b, &i); err != nil {
+		return err
+	}
+
+	key, err := decodeKey(i.Key)
+	if err != nil {
+		return err
+	}
+	data := make(map[interface{}]float64, len(i.Data))
+	for _, e := range i.Data {
+		dk, err := decodeKey(e.Key)
+		if err != nil {
+			return err
+		}
+		data[dk] = e.Value
+	}
+
+	item.Lock()
+	item.key = key
+	item.data = data
+	item.Unlock()
+
+	item.metaMutex.Lock()
+	item.meta = i.Meta
+	item.metaMutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Levels a Logger gets called with.
+const (
+	// Diagnostics logged in verbose mode, see SetVerbose.
+	LevelDebug = "debug"
+	// Noteworthy events, like flushing a table.
+	LevelInfo = "info"
+)
+
+// Receives a table's log messages, see SetLogger. args are pairs of keys and
+// values, like "table", "books", in the style of log/slog.
+type Logger interface {
+	Log(level, msg string, args ...interface{})
+}
+
+// Returns a Logger printing a line per message to l, followed by its
+// key=value pairs.
+func StdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+// A Logger printing to a log.Logger.
+type stdLogger struct {
+	logger *log.Logger
+}
+
+func (l stdLogger) Log(level, msg string, args ...interface{}) {
+	parts := []string{msg}
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			parts = append(parts, fmt.Sprint(args[i]))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%v=%v", args[i], args[i+1]))
+	}
+
+	l.logger.Println(strings.Join(parts, " "))
+}
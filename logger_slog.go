@@ -0,0 +1,36 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Returns a Logger passing messages on to l, LevelDebug ones at
+// slog.LevelDebug and all others at slog.LevelInfo.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+// A Logger passing messages on to a slog.Logger.
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l slogLogger) Log(level, msg string, args ...interface{}) {
+	lvl := slog.LevelInfo
+	if level == LevelDebug {
+		lvl = slog.LevelDebug
+	}
+
+	l.logger.Log(context.Background(), lvl, msg, args...)
+}
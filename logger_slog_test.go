@@ -0,0 +1,39 @@
+//go:build go1.21
+// +build go1.21
+
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	books := New("slog", WithLogger(SlogLogger(logger)))
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+
+	books.Flush()
+	if !strings.Contains(buf.String(), `level=INFO msg="Flushing table" table=slog items=2`) {
+		t.Errorf("Expected structured flush message, got %q", buf.String())
+	}
+
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	books.SetVerbose(true)
+	books.Neighbors("Chris")
+	if !strings.Contains(buf.String(), `level=DEBUG msg="Found shared" table=slog dataKey=1984 score=5 otherScore=4`) {
+		t.Errorf("Expected debug diagnostics, got %q", buf.String())
+	}
+}
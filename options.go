@@ -0,0 +1,199 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+// Settings for a single call to Recommend.
+type recommendOptions struct {
+	// Data keys never to recommend.
+	exclude map[interface{}]bool
+	// Whether to drop recommendations scoring below minScore.
+	hasMinScore bool
+	minScore    float64
+	// How to normalize the scores.
+	normalization Normalization
+	// Whether to also score data keys the item scored already.
+	includeRated bool
+	// Whether to drop recommendations with a negative score.
+	excludeNegative bool
+	// Whether data keys the item scored negatively are never recommended.
+	vetoDisliked bool
+	// Drops candidates it returns false for, if set.
+	filter func(key interface{}, score float64) bool
+	// Like filter, but also gets the item recommendations are made for.
+	itemFilter func(item *RegommendItem, key interface{}, score float64) bool
+	// How much to favor diverse recommendations, disabled if zero.
+	diversity float64
+	// Overlap needed for neighbors to count fully, disabled if zero.
+	significanceCap int
+	// How many contributors RecommendExplained lists, all if zero or less.
+	explainLimit int
+}
+
+// An option changing the behavior of a single call to Recommend.
+type RecommendOption func(*recommendOptions)
+
+// Never recommends the data keys contained in set, e.g. items already shown
+// or out of stock. The set isn't copied and must not be modified during the
+// call.
+func Exclude(set map[interface{}]bool) RecommendOption {
+	return func(o *recommendOptions) {
+		o.exclude = set
+	}
+}
+
+// Drops recommendations whose final, aggregated score is below score.
+func MinScore(score float64) RecommendOption {
+	return func(o *recommendOptions) {
+		o.hasMinScore = true
+		o.minScore = score
+	}
+}
+
+// How recommendation scores get normalized, see Normalize.
+type Normalization int
+
+const (
+	// Leaves scores as they are.
+	NormalizeNone Normalization = iota
+	// Scales scores linearly to [0, 1] over the returned recommendations,
+	// so the best one scores 1 and the worst one 0. If all of them score
+	// the same, they all score 1.
+	NormalizeMinMax
+	// Divides each score by the similarities of the neighbors who scored
+	// its data key, bringing it back onto the scale of the original
+	// scores. Scores are on that scale already with WeightedAverage
+	// aggregation, for RecommendItemBased and for popular fallbacks, so
+	// it leaves them as they are, just like NormalizeNone.
+	NormalizeRatingScale
+)
+
+// Normalizes the scores of the returned recommendations. The unnormalized
+// score is kept in each Recommendation's Raw field. MinScore always applies
+// to the unnormalized scores.
+func Normalize(n Normalization) RecommendOption {
+	return func(o *recommendOptions) {
+		o.normalization = n
+	}
+}
+
+// Also scores the data keys the item scored itself, which are skipped by
+// default. Their recommendations are flagged as Rated and carry the item's
+// actual score as Rating, e.g. for comparing predictions against it.
+func IncludeRated() RecommendOption {
+	return func(o *recommendOptions) {
+		o.includeRated = true
+	}
+}
+
+// Drops recommendations predicting a dislike, i.e. scoring below zero.
+// Scores below zero mean dislikes: a neighbor's negative score counts
+// against a data key just like a positive one counts for it, so a data key
+// neighbors disliked ends up with a negative score, rather than just a low
+// one.
+func ExcludeNegative() RecommendOption {
+	return func(o *recommendOptions) {
+		o.excludeNegative = true
+	}
+}
+
+// Never recommends data keys the item itself scored below zero, even with
+// IncludeRated.
+func VetoDisliked() RecommendOption {
+	return func(o *recommendOptions) {
+		o.vetoDisliked = true
+	}
+}
+
+// Reports whether a data key must not be recommended as the item scored it
+// x already, if rated is set.
+func (o *recommendOptions) skipRated(x float64, rated bool) bool {
+	if !rated {
+		return false
+	}
+
+	return !o.includeRated || (o.vetoDisliked && x < 0)
+}
+
+// Reports whether a recommendation gets dropped for its unnormalized score.
+func (o *recommendOptions) dropScore(raw float64) bool {
+	return (o.hasMinScore && raw < o.minScore) || (o.excludeNegative && raw < 0)
+}
+
+// Drops all candidates for which f returns false, before keeping the best
+// ones, so the next best candidates take their place. Useful for dynamic
+// rules like regional availability. f gets called while holding the table's
+// read lock, so it must not modify the table. A panic in f is passed on to
+// the caller, leaving the table untouched.
+func Filter(f func(key interface{}, score float64) bool) RecommendOption {
+	return func(o *recommendOptions) {
+		o.filter = f
+	}
+}
+
+// Like Filter, but f also gets the item recommendations are made for, e.g.
+// to check its metadata, see RegommendItem.Meta. The item is nil for ad-hoc
+// profiles, see RecommendForProfile.
+func FilterWithItem(f func(item *RegommendItem, key interface{}, score float64) bool) RecommendOption {
+	return func(o *recommendOptions) {
+		o.itemFilter = f
+	}
+}
+
+// Returns the options to use for recommendations for item, passing it on
+// to the filter of FilterWithItem.
+func (o *recommendOptions) forItem(item *RegommendItem) *recommendOptions {
+	if o.itemFilter == nil {
+		return o
+	}
+
+	bound := *o
+	filter, itemFilter := o.filter, o.itemFilter
+	bound.filter = func(key interface{}, score float64) bool {
+		if filter != nil && !filter(key, score) {
+			return false
+		}
+		return itemFilter(item, key, score)
+	}
+	return &bound
+}
+
+// Re-ranks the recommendations to be less similar to each other, using
+// maximal marginal relevance. Picks recommendations one by one, favoring a
+// high score but penalizing them by lambda times their highest similarity
+// to those picked already. Similarities between data keys are computed like
+// for ItemNeighbors. Scores are scaled to [0, 1] for picking, so a lambda of
+// 1 weighs both aspects about the same. Zero only considers scores, which
+// is the default. Only the best few candidates are considered for each of
+// the n recommendations, which keeps it affordable.
+func Diversify(lambda float64) RecommendOption {
+	return func(o *recommendOptions) {
+		o.diversity = lambda
+	}
+}
+
+// Weighs each neighbor's scores by how much evidence backs its similarity,
+// multiplying its weight by min(n, cap)/cap, where n is the number of keys
+// it shares with the item recommendations are made for. Unlike the table's
+// SetSimilarityShrinkage, this only affects recommendations.
+func SignificanceCap(cap int) RecommendOption {
+	return func(o *recommendOptions) {
+		o.significanceCap = cap
+	}
+}
+
+// Applies the given options to the defaults.
+func newRecommendOptions(opts []RecommendOption) *recommendOptions {
+	o := &recommendOptions{
+		explainLimit: defaultExplainLimit,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
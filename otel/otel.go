@@ -0,0 +1,110 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+// Package otel traces the operations of regommend tables with OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/muesli/regommend"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys recorded on spans.
+const (
+	// The name of the table.
+	TableKey = attribute.Key("regommend.table")
+	// The key of the item an operation was made for.
+	ItemKey = attribute.Key("regommend.key")
+	// How many results an operation returned.
+	ResultCountKey = attribute.Key("regommend.result_count")
+	// The scores of the returned recommendations, best first.
+	ScoresKey = attribute.Key("regommend.scores")
+)
+
+// A RegommendTable whose Add, Delete, Value and Recommend methods create a
+// span each. All other methods are the table's own and don't get traced.
+type TracedTable struct {
+	*regommend.RegommendTable
+
+	tracer trace.Tracer
+}
+
+// Returns a TracedTable wrapping t, creating spans with the given tracer.
+func NewTracedTable(t *regommend.RegommendTable, tracer trace.Tracer) *TracedTable {
+	return &TracedTable{
+		RegommendTable: t,
+		tracer:         tracer,
+	}
+}
+
+// Starts a span for the named operation on the item with the given key.
+func (t *TracedTable) start(ctx context.Context, name string, key interface{}) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, "regommend."+name, trace.WithAttributes(
+		TableKey.String(t.Name()),
+		ItemKey.String(fmt.Sprint(key)),
+	))
+}
+
+// Ends span, recording err unless it's nil.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Adds the given key and data to the table, see RegommendTable.Add.
+func (t *TracedTable) Add(ctx context.Context, key interface{}, data map[interface{}]float64) *regommend.RegommendItem {
+	_, span := t.start(ctx, "Add", key)
+	defer end(span, nil)
+
+	return t.RegommendTable.Add(key, data)
+}
+
+// Deletes the item with the given key, see RegommendTable.Delete.
+func (t *TracedTable) Delete(ctx context.Context, key interface{}) (*regommend.RegommendItem, error) {
+	_, span := t.start(ctx, "Delete", key)
+	item, err := t.RegommendTable.Delete(key)
+	end(span, err)
+
+	return item, err
+}
+
+// Returns the item with the given key, see RegommendTable.ValueCtx.
+func (t *TracedTable) Value(ctx context.Context, key interface{}) (*regommend.RegommendItem, error) {
+	ctx, span := t.start(ctx, "Value", key)
+	item, err := t.RegommendTable.ValueCtx(ctx, key)
+	end(span, err)
+
+	return item, err
+}
+
+// Returns the n best recommendations for the item with the given key, see
+// RegommendTable.RecommendCtx. Records how many got returned, along with
+// their scores.
+func (t *TracedTable) Recommend(ctx context.Context, key interface{}, n int, opts ...regommend.RecommendOption) (regommend.RecommendationList, error) {
+	ctx, span := t.start(ctx, "Recommend", key)
+	recs, err := t.RegommendTable.RecommendCtx(ctx, key, n, opts...)
+
+	scores := make([]float64, len(recs))
+	for i, r := range recs {
+		scores[i] = r.Score
+	}
+	span.SetAttributes(
+		ResultCountKey.Int(len(recs)),
+		ScoresKey.Float64Slice(scores),
+	)
+	end(span, err)
+
+	return recs, err
+}
@@ -0,0 +1,75 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package otel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/muesli/regommend"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+
+	return attrs
+}
+
+func TestTracedTable(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	books := NewTracedTable(regommend.New("traced"), provider.Tracer("test"))
+	ctx := context.Background()
+
+	books.Add(ctx, "Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add(ctx, "Jay", map[interface{}]float64{"1984": 5.0, "Dune": 4.0})
+	recs, err := books.Recommend(ctx, "Chris", 0)
+	if err != nil || len(recs) != 1 {
+		t.Fatal("Unexpected recommendations", recs, err)
+	}
+	if _, err := books.Value(ctx, "Tom"); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+	books.Delete(ctx, "Jay")
+
+	spans := recorder.Ended()
+	if len(spans) != 5 {
+		t.Fatal("Expected 5 spans, got", len(spans))
+	}
+	names := []string{"regommend.Add", "regommend.Add", "regommend.Recommend", "regommend.Value", "regommend.Delete"}
+	for i, span := range spans {
+		if span.Name() != names[i] {
+			t.Error("Expected span", names[i], "got", span.Name())
+		}
+		if attributes(span)[TableKey].AsString() != "traced" {
+			t.Error("Expected table name to be recorded, got", span.Attributes())
+		}
+	}
+
+	attrs := attributes(spans[2])
+	if attrs[ItemKey].AsString() != "Chris" || attrs[ResultCountKey].AsInt64() != 1 {
+		t.Error("Expected key and result count to be recorded, got", spans[2].Attributes())
+	}
+	if scores := attrs[ScoresKey].AsFloat64Slice(); len(scores) != 1 || scores[0] != recs[0].Score {
+		t.Error("Expected scores to be recorded, got", scores)
+	}
+
+	if spans[3].Status().Code != codes.Error || len(spans[3].Events()) != 1 {
+		t.Error("Expected error to be recorded, got", spans[3].Status())
+	}
+	if spans[4].Status().Code == codes.Error {
+		t.Error("Expected no error for deleting an existing item")
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// How often a data key got scored, and the sum of its scores.
+type popularityStats struct {
+	count int
+	sum   float64
+}
+
+// Returns the average score.
+func (s *popularityStats) average() float64 {
+	return s.sum / float64(s.count)
+}
+
+// A data key along with its popularity.
+type popularKey struct {
+	key   interface{}
+	stats popularityStats
+}
+
+// Returns whether a is more popular than b: scored more often, then with a
+// higher average score, then by the string form of their keys.
+func morePopular(a, b popularKey) bool {
+	if a.stats.count != b.stats.count {
+		return a.stats.count > b.stats.count
+	}
+	if a.stats.average() != b.stats.average() {
+		return a.stats.average() > b.stats.average()
+	}
+
+	return keyString(a.key) < keyString(b.key)
+}
+
+// A list of popularKeys, sortable by descending popularity.
+type popularKeyList []popularKey
+
+func (p popularKeyList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p popularKeyList) Len() int           { return len(p) }
+func (p popularKeyList) Less(i, j int) bool { return morePopular(p[i], p[j]) }
+
+// A bounded min-heap keeping the most popular keys, see distanceHeap.
+type popularKeyHeap []popularKey
+
+func (h popularKeyHeap) Len() int            { return len(h) }
+func (h popularKeyHeap) Less(i, j int) bool  { return morePopular(h[j], h[i]) }
+func (h popularKeyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *popularKeyHeap) Push(x interface{}) { *h = append(*h, x.(popularKey)) }
+func (h *popularKeyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Adds p to the heap, dropping the least popular key if it holds more
+// than n keys.
+func (h *popularKeyHeap) offer(p popularKey, n int) {
+	if h.Len() < n {
+		heap.Push(h, p)
+	} else if morePopular(p, (*h)[0]) {
+		(*h)[0] = p
+		heap.Fix(h, 0)
+	}
+}
+
+// Recommends the most popular data keys instead, whenever fewer than min
+// neighbors contribute to the recommendations of an item, e.g. for new
+// items with hardly any scores. Popularity is judged by how many items
+// scored a data key, then by its average score. Such recommendations are
+// flagged as Fallback and their score is the average score of the data
+// key. Zero or less disables the fallback, which is the default.
+func (table *RegommendTable) SetPopularityFallback(min int) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.fallbackMin = min
+	if min <= 0 {
+		table.popularity = nil
+		return
+	}
+	if table.popularity == nil {
+		table.rebuildPopularity()
+	}
+}
+
+// Recomputes the popularity of all data keys, if the fallback is enabled.
+// Callers must hold the table lock.
+func (table *RegommendTable) rebuildPopularity() {
+	if table.fallbackMin <= 0 {
+		return
+	}
+
+	table.popularity = make(map[interface{}]*popularityStats)
+	for _, item := range table.items {
+		table.trackPopularity(nil, item.Data())
+	}
+}
+
+// Updates the popularity of data keys after an item's data changed from
+// old to data, either of which may be nil. Callers must hold the table
+// lock.
+func (table *RegommendTable) trackPopularity(old, data map[interface{}]float64) {
+	if table.popularity == nil {
+		return
+	}
+
+	for k, x := range old {
+		s := table.popularity[k]
+		s.count--
+		s.sum -= x
+		if s.count == 0 {
+			delete(table.popularity, k)
+		}
+	}
+	for k, x := range data {
+		s, ok := table.popularity[k]
+		if !ok {
+			s = &popularityStats{}
+			table.popularity[k] = s
+		}
+		s.count++
+		s.sum += x
+	}
+}
+
+// Returns the n most popular data keys as recommendations for an item with
+// data smap, or all of them if n is zero or negative. Callers must hold the
+// table lock.
+func (table *RegommendTable) popular(smap map[interface{}]float64, n int, opts *recommendOptions) RecommendationList {
+	keys := popularKeyList{}
+	top := popularKeyHeap{}
+	for k, s := range table.popularity {
+		if rating, ok := smap[k]; opts.skipRated(rating, ok) {
+			continue
+		}
+		if opts.exclude[k] {
+			continue
+		}
+		if opts.dropScore(s.average()) {
+			continue
+		}
+		if opts.filter != nil && !opts.filter(k, s.average()) {
+			continue
+		}
+
+		p := popularKey{
+			key:   k,
+			stats: *s,
+		}
+		if n > 0 {
+			top.offer(p, n)
+		} else {
+			keys = append(keys, p)
+		}
+	}
+	if n > 0 {
+		keys = popularKeyList(top)
+	}
+	sort.Sort(keys)
+
+	recs := make(RecommendationList, len(keys))
+	for i, p := range keys {
+		// Confidence is the share of items having scored the data key.
+		recs[i] = Recommendation{
+			Key:          p.key,
+			Score:        p.stats.average(),
+			Raw:          p.stats.average(),
+			Fallback:     true,
+			Confidence:   float64(p.stats.count) / float64(len(table.items)),
+			Contributors: p.stats.count,
+		}
+		recs[i].Rating, recs[i].Rated = smap[p.key]
+	}
+	if opts.normalization == NormalizeMinMax {
+		normalizeMinMax(recs)
+	}
+
+	return recs
+}
@@ -0,0 +1,60 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// Returned by PredictScore when no similar item scored the data key.
+	ErrNotEnoughData = errors.New("Not enough data to predict a score")
+)
+
+// Predicts the score the item with the given key would give dataKey: the
+// average of the scores given by the other items who scored dataKey,
+// weighted by their similarity, no matter the table's Aggregation. Only
+// those items get compared, which is much cheaper than Recommend for a
+// single data key. Returns ErrNotEnoughData if none of them is similar at
+// all. Unlike Value, this doesn't count as an access.
+func (table *RegommendTable) PredictScore(key interface{}, dataKey interface{}) (float64, error) {
+	table.RLock()
+	defer table.RUnlock()
+
+	sitem, ok := table.items[key]
+	if !ok {
+		return 0, errors.New("Key not found in engine")
+	}
+
+	distanceTo := table.distanceTo(key, sitem.Data(), false)
+	now := time.Now()
+	sum := 0.0
+	totalDistance := 0.0
+	for k, item := range table.items {
+		if k == key || table.expired(item, now) {
+			continue
+		}
+		if _, ok := item.Data()[dataKey]; !ok {
+			continue
+		}
+		x := table.decayed(item, now)[dataKey]
+
+		distance, ok := distanceTo(k, item)
+		if !ok || distance.Distance <= 0 {
+			continue
+		}
+		sum += x * distance.Distance
+		totalDistance += distance.Distance
+	}
+	if totalDistance == 0 {
+		return 0, ErrNotEnoughData
+	}
+
+	return sum / totalDistance, nil
+}
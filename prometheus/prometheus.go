@@ -0,0 +1,243 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+// Package prometheus exports metrics of regommend tables to Prometheus.
+package prometheus
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/muesli/regommend"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The namespace of all metrics.
+const namespace = "regommend"
+
+// A RegommendTable recording metrics. Items get counted as added no matter
+// which method added them, as the table's added-item callback counts them,
+// see SetAddedItemCallback. Likewise, expired items always get counted as
+// deleted, see SetExpiredItemCallback. Other deletions, misses and the time
+// taken to compute recommendations only get recorded by the methods wrapped
+// here, so calling Delete, Flush or Value on the wrapped table directly, or
+// replacing its items by decoding them, doesn't count.
+type InstrumentedTable struct {
+	*regommend.RegommendTable
+
+	adds      prometheus.Counter
+	deletes   prometheus.Counter
+	misses    prometheus.Counter
+	loads     prometheus.Counter
+	recommend prometheus.Histogram
+
+	// Set while a data loader counting misses is configured, accessed
+	// atomically.
+	loading int32
+	// The callbacks configured by SetAddedItemCallback and
+	// SetExpiredItemCallback.
+	addedItem     func(*regommend.RegommendItem)
+	expiredItem   func(*regommend.RegommendItem)
+	callbackMutex sync.RWMutex
+}
+
+// Returns an InstrumentedTable wrapping t, registering its metrics with reg.
+// All metrics are labeled with the table's name, so several tables can be
+// registered with the same Registerer. Panics if registering fails, like
+// prometheus.MustRegister. Takes over the table's added-item and
+// expired-item callbacks, use the InstrumentedTable's SetAddedItemCallback
+// and SetExpiredItemCallback to configure them.
+func NewInstrumentedTable(t *regommend.RegommendTable, reg prometheus.Registerer) *InstrumentedTable {
+	labels := prometheus.Labels{"table_name": t.Name()}
+	it := &InstrumentedTable{
+		RegommendTable: t,
+		adds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "adds_total",
+			Help:        "Number of items added to the table.",
+			ConstLabels: labels,
+		}),
+		deletes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "deletes_total",
+			Help:        "Number of items deleted from the table.",
+			ConstLabels: labels,
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "misses_total",
+			Help:        "Number of values requested for keys not in the table.",
+			ConstLabels: labels,
+		}),
+		loads: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "loads_total",
+			Help:        "Number of invocations of the table's data loader.",
+			ConstLabels: labels,
+		}),
+		recommend: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "recommend_duration_seconds",
+			Help:        "Time taken to compute recommendations.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}),
+	}
+	items := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "items",
+		Help:        "Number of items in the table.",
+		ConstLabels: labels,
+	}, func() float64 {
+		return float64(t.Count())
+	})
+
+	reg.MustRegister(it.adds, it.deletes, it.misses, it.loads, it.recommend, items)
+	t.SetAddedItemCallback(it.added)
+	t.SetExpiredItemCallback(it.expired)
+	return it
+}
+
+// Counts an added item and triggers the configured added-item callback.
+func (it *InstrumentedTable) added(item *regommend.RegommendItem) {
+	it.adds.Inc()
+
+	it.callbackMutex.RLock()
+	addedItem := it.addedItem
+	it.callbackMutex.RUnlock()
+	if addedItem != nil {
+		addedItem(item)
+	}
+}
+
+// Configures a callback, which will be called every time a new item is
+// added to the table, see RegommendTable.SetAddedItemCallback. Added items
+// keep getting counted.
+func (it *InstrumentedTable) SetAddedItemCallback(f func(*regommend.RegommendItem)) {
+	it.callbackMutex.Lock()
+	defer it.callbackMutex.Unlock()
+	it.addedItem = f
+}
+
+// Counts an expired item as deleted and triggers the configured
+// expired-item callback.
+func (it *InstrumentedTable) expired(item *regommend.RegommendItem) {
+	it.deletes.Inc()
+
+	it.callbackMutex.RLock()
+	expiredItem := it.expiredItem
+	it.callbackMutex.RUnlock()
+	if expiredItem != nil {
+		expiredItem(item)
+	}
+}
+
+// Configures a callback, which will be called every time an item expired,
+// see RegommendTable.SetExpiredItemCallback. Expired items keep getting
+// counted.
+func (it *InstrumentedTable) SetExpiredItemCallback(f func(*regommend.RegommendItem)) {
+	it.callbackMutex.Lock()
+	defer it.callbackMutex.Unlock()
+	it.expiredItem = f
+}
+
+// Deletes the item with the given key, see RegommendTable.Delete.
+func (it *InstrumentedTable) Delete(key interface{}) (*regommend.RegommendItem, error) {
+	item, err := it.RegommendTable.Delete(key)
+	if err == nil {
+		it.deletes.Inc()
+	}
+
+	return item, err
+}
+
+// Deletes all items, see RegommendTable.Flush. Counts every item the table
+// held right before as deleted, so items added or deleted concurrently may
+// get miscounted.
+func (it *InstrumentedTable) Flush() {
+	n := it.RegommendTable.Count()
+	it.RegommendTable.Flush()
+	it.deletes.Add(float64(n))
+}
+
+// Returns the item with the given key, see RegommendTable.Value. Counts a
+// miss if the key isn't in the table, even if the data loader provides it.
+func (it *InstrumentedTable) Value(key interface{}) (*regommend.RegommendItem, error) {
+	item, err := it.RegommendTable.Value(key)
+	// Invoking the data loader counted the miss already.
+	if err != nil && atomic.LoadInt32(&it.loading) == 0 {
+		it.misses.Inc()
+	}
+
+	return item, err
+}
+
+// Configures the table's data loader, see RegommendTable.SetDataLoader.
+// Each invocation counts as a load and a miss. Loaders configured on the
+// wrapped table directly don't get counted.
+func (it *InstrumentedTable) SetDataLoader(f func(interface{}) *regommend.RegommendItem) {
+	if f == nil {
+		atomic.StoreInt32(&it.loading, 0)
+		it.RegommendTable.SetDataLoader(nil)
+		return
+	}
+
+	atomic.StoreInt32(&it.loading, 1)
+	it.RegommendTable.SetDataLoader(func(key interface{}) *regommend.RegommendItem {
+		it.loads.Inc()
+		it.misses.Inc()
+		return f(key)
+	})
+}
+
+// Returns the n best recommendations for the item with the given key, see
+// RegommendTable.Recommend.
+func (it *InstrumentedTable) Recommend(key interface{}, n int, opts ...regommend.RecommendOption) (regommend.RecommendationList, error) {
+	defer it.observe(time.Now())
+	return it.RegommendTable.Recommend(key, n, opts...)
+}
+
+// Like Recommend, but gives up once ctx is done, see
+// RegommendTable.RecommendCtx.
+func (it *InstrumentedTable) RecommendCtx(ctx context.Context, key interface{}, n int, opts ...regommend.RecommendOption) (regommend.RecommendationList, error) {
+	defer it.observe(time.Now())
+	return it.RegommendTable.RecommendCtx(ctx, key, n, opts...)
+}
+
+// Like Recommend, but explains each recommendation, see
+// RegommendTable.RecommendExplained.
+func (it *InstrumentedTable) RecommendExplained(key interface{}, n int, opts ...regommend.RecommendOption) ([]regommend.ExplainedRecommendation, error) {
+	defer it.observe(time.Now())
+	return it.RegommendTable.RecommendExplained(key, n, opts...)
+}
+
+// Returns recommendations for an ad-hoc profile, see
+// RegommendTable.RecommendForProfile.
+func (it *InstrumentedTable) RecommendForProfile(data map[interface{}]float64, n int, opts ...regommend.RecommendOption) regommend.RecommendationList {
+	defer it.observe(time.Now())
+	return it.RegommendTable.RecommendForProfile(data, n, opts...)
+}
+
+// Returns recommendations for several keys at once, see
+// RegommendTable.RecommendBatch. Gets recorded as a single observation.
+func (it *InstrumentedTable) RecommendBatch(keys []interface{}, n int, opts ...regommend.RecommendOption) (map[interface{}]regommend.RecommendationList, map[interface{}]error) {
+	defer it.observe(time.Now())
+	return it.RegommendTable.RecommendBatch(keys, n, opts...)
+}
+
+// Returns item-based recommendations, see RegommendTable.RecommendItemBased.
+func (it *InstrumentedTable) RecommendItemBased(key interface{}, n int, opts ...regommend.RecommendOption) (regommend.RecommendationList, error) {
+	defer it.observe(time.Now())
+	return it.RegommendTable.RecommendItemBased(key, n, opts...)
+}
+
+// Records the time taken to compute recommendations since start.
+func (it *InstrumentedTable) observe(start time.Time) {
+	it.recommend.Observe(time.Since(start).Seconds())
+}
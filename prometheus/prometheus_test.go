@@ -0,0 +1,108 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package prometheus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/muesli/regommend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentedTable(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	books := NewInstrumentedTable(regommend.New("books"), reg)
+	movies := NewInstrumentedTable(regommend.New("movies"), reg)
+
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0, "Dune": 3.0})
+	movies.Add("Chris", map[interface{}]float64{"Alien": 5.0})
+	books.AddOrUpdate("Tom", map[interface{}]float64{"Emma": 2.0})
+	books.AddOrUpdate("Tom", map[interface{}]float64{"Dune": 2.0})
+	books.IncrementRating("Ann", "Dune", 1.0)
+	added := 0
+	books.SetAddedItemCallback(func(item *regommend.RegommendItem) {
+		added++
+	})
+	books.AddWithTTL("Bob", map[interface{}]float64{"1984": 1.0}, 0)
+	books.Recommend("Chris", 0)
+	books.Delete("Jay")
+	books.Delete("Jim")
+	books.Value("Jim")
+
+	books.SetDataLoader(func(key interface{}) *regommend.RegommendItem {
+		item := regommend.CreateRegommendItem(key, map[interface{}]float64{"Emma": 1.0})
+		return &item
+	})
+	books.Value("Mary")
+	books.Value("Mary")
+	if added != 2 {
+		t.Error("Expected added-item callback to fire twice, got", added)
+	}
+
+	expected := `
+# HELP regommend_adds_total Number of items added to the table.
+# TYPE regommend_adds_total counter
+regommend_adds_total{table_name="books"} 6
+regommend_adds_total{table_name="movies"} 1
+# HELP regommend_deletes_total Number of items deleted from the table.
+# TYPE regommend_deletes_total counter
+regommend_deletes_total{table_name="books"} 1
+regommend_deletes_total{table_name="movies"} 0
+# HELP regommend_items Number of items in the table.
+# TYPE regommend_items gauge
+regommend_items{table_name="books"} 5
+regommend_items{table_name="movies"} 1
+# HELP regommend_loads_total Number of invocations of the table's data loader.
+# TYPE regommend_loads_total counter
+regommend_loads_total{table_name="books"} 1
+regommend_loads_total{table_name="movies"} 0
+# HELP regommend_misses_total Number of values requested for keys not in the table.
+# TYPE regommend_misses_total counter
+regommend_misses_total{table_name="books"} 2
+regommend_misses_total{table_name="movies"} 0
+`
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"regommend_adds_total", "regommend_deletes_total", "regommend_items", "regommend_loads_total", "regommend_misses_total")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(books.recommend); n != 1 {
+		t.Error("Expected a recommendation latency histogram, got", n)
+	}
+}
+
+func TestInstrumentedTableEvictions(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	table := regommend.New("evictions")
+	defer table.StopTTL()
+	books := NewInstrumentedTable(table, reg)
+
+	expired := make(chan *regommend.RegommendItem, 1)
+	books.SetExpiredItemCallback(func(item *regommend.RegommendItem) {
+		expired <- item
+	})
+	books.AddWithTTL("Chris", map[interface{}]float64{"1984": 5.0}, 10*time.Millisecond)
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Chris to expire")
+	}
+
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	books.Add("Mary", map[interface{}]float64{"Emma": 3.0})
+	books.Flush()
+
+	if n := testutil.ToFloat64(books.deletes); n != 3 {
+		t.Error("Expected expired and flushed items to count as deleted, got", n)
+	}
+}
@@ -8,31 +8,162 @@
 package regommend
 
 import (
+	"errors"
+	"sort"
 	"sync"
 )
 
+// Structure of an engine, owning a set of named tables. Engines are
+// independent of each other, tables of the same name in different engines
+// don't share anything.
+type Engine struct {
+	sync.RWMutex
+
+	// All tables of the engine.
+	tables map[string]*RegommendTable
+}
+
 var (
-	tables = make(map[string]*RegommendTable)
-	mutex sync.RWMutex
+	// The engine used by the package-level functions.
+	defaultEngine = NewEngine()
+
+	// Returned when a table doesn't exist in the engine.
+	ErrTableNotFound = errors.New("Table not found in engine")
 )
 
+// Returns a new engine without any tables.
+func NewEngine() *Engine {
+	return &Engine{
+		tables: make(map[string]*RegommendTable),
+	}
+}
+
 // Returns the existing engine table with given name or creates a new one
 // if the table does not exist yet.
-func Table(table string) *RegommendTable {
-	mutex.RLock()
-	t, ok := tables[table]
-	mutex.RUnlock()
+func (engine *Engine) Table(table string) *RegommendTable {
+	return engine.CreateTable(table)
+}
+
+// Like Table, but configures the table with the given options. If the table
+// exists already, the options get applied to it.
+func (engine *Engine) CreateTable(table string, opts ...Option) *RegommendTable {
+	engine.RLock()
+	t, ok := engine.tables[table]
+	engine.RUnlock()
 
 	if !ok {
-		t = &RegommendTable{
-			name:  table,
-			items: make(map[interface{}]*RegommendItem),
+		engine.Lock()
+		// Someone else might have created it in the meantime.
+		t, ok = engine.tables[table]
+		if !ok {
+			t = New(table)
+			engine.tables[table] = t
 		}
+		engine.Unlock()
+	}
 
-		mutex.Lock()
-		tables[table] = t
-		mutex.Unlock()
+	for _, opt := range opts {
+		opt(t)
 	}
 
 	return t
 }
+
+// Returns whether a table with the given name exists in the engine.
+func (engine *Engine) Exists(table string) bool {
+	engine.RLock()
+	defer engine.RUnlock()
+	_, ok := engine.tables[table]
+	return ok
+}
+
+// Returns the sorted names of all tables in the engine.
+func (engine *Engine) Tables() []string {
+	engine.RLock()
+	defer engine.RUnlock()
+
+	names := make([]string, 0, len(engine.tables))
+	for name := range engine.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Deletes all items from all tables in the engine, see RegommendTable.Flush.
+func (engine *Engine) FlushAll() {
+	engine.RLock()
+	tables := make([]*RegommendTable, 0, len(engine.tables))
+	for _, t := range engine.tables {
+		tables = append(tables, t)
+	}
+	engine.RUnlock()
+
+	for _, t := range tables {
+		t.Flush()
+	}
+}
+
+// Removes the table with the given name from the engine entirely. Triggers
+// the aboutToDeleteItem callback for every item left in the table, then
+// deletes them and stops expiring items. Returns ErrTableNotFound if there's
+// no such table.
+func (engine *Engine) DropTable(table string) error {
+	engine.Lock()
+	t, ok := engine.tables[table]
+	if !ok {
+		engine.Unlock()
+		return ErrTableNotFound
+	}
+	// Removed right away, so no one else gets to use the table meanwhile.
+	delete(engine.tables, table)
+	engine.Unlock()
+
+	t.StopTTL()
+
+	t.RLock()
+	items := make([]*RegommendItem, 0, len(t.items))
+	for _, item := range t.items {
+		items = append(items, item)
+	}
+	aboutToDeleteItem := t.aboutToDeleteItem
+	t.RUnlock()
+
+	if aboutToDeleteItem != nil {
+		for _, item := range items {
+			aboutToDeleteItem(item)
+		}
+	}
+	t.Flush()
+
+	return nil
+}
+
+// Returns the existing engine table with given name or creates a new one
+// if the table does not exist yet. Uses the package's default engine.
+func Table(table string) *RegommendTable {
+	return defaultEngine.Table(table)
+}
+
+// Returns whether a table with the given name exists in the package's
+// default engine.
+func Exists(table string) bool {
+	return defaultEngine.Exists(table)
+}
+
+// Returns the sorted names of all tables in the package's default engine.
+func Tables() []string {
+	return defaultEngine.Tables()
+}
+
+// Deletes all items from all tables in the package's default engine.
+func FlushAll() {
+	defaultEngine.FlushAll()
+}
+
+// Removes the table with the given name from the package's default engine,
+// see Engine.DropTable.
+func DropTable(table string) error {
+	return defaultEngine.DropTable(table)
+}
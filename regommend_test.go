@@ -8,7 +8,20 @@
 package regommend
 
 import (
+	"bytes"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -91,7 +104,7 @@ func TestRecommendations(t *testing.T) {
 	booksJayRead["A Tale of Two Cities"] = 3.5
 	books.Add("Jay", booksJayRead)
 
-	recs, _ := books.Recommend("Chris")
+	recs, _ := books.Recommend("Chris", 0)
 	if len(recs) != 2 {
 		t.Error("Expected 2 recommendations, got", len(recs))
 	}
@@ -99,3 +112,2906 @@ func TestRecommendations(t *testing.T) {
 		t.Error("Unexpected recommendation order")
 	}
 }
+
+func TestSimilarityFunc(t *testing.T) {
+	people := Table("similarityfunc")
+	people.Add("Chris", map[interface{}]float64{"a": 5.0, "b": 4.0})
+	people.Add("Jay", map[interface{}]float64{"a": 5.0, "b": 4.0})
+	people.Add("Mary", map[interface{}]float64{"c": 1.0, "d": 1.0, "e": 1.0})
+
+	nbs, _ := people.Neighbors("Chris")
+	if nbs[0].Key != "Jay" {
+		t.Error("Expected Jay to be the closest neighbor, got", nbs[0].Key)
+	}
+
+	people.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return 0.5
+	})
+	nbs, _ = people.Neighbors("Chris")
+	for _, nb := range nbs {
+		if nb.Distance != 0.5 {
+			t.Error("Expected distance 0.5 from custom metric, got", nb.Distance)
+		}
+	}
+
+	// rank neighbors by the size of their profile
+	people.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return float64(len(t2))
+	})
+	nbs, _ = people.Neighbors("Chris")
+	if nbs[0].Key != "Mary" || nbs[1].Key != "Jay" {
+		t.Error("Unexpected similarity order with custom metric")
+	}
+
+	people.SetSimilarityFunc(nil)
+	nbs, _ = people.Neighbors("Chris")
+	if nbs[0].Key != "Jay" {
+		t.Error("Expected default metric to be restored")
+	}
+}
+
+func TestPearsonMetric(t *testing.T) {
+	people := Table("pearson")
+	people.Add("Chris", map[interface{}]float64{"a": 5.0, "b": 3.0, "c": 1.0})
+	people.Add("Jay", map[interface{}]float64{"a": 4.5, "b": 3.5, "c": 2.5})
+	people.Add("Mary", map[interface{}]float64{"a": 5.0, "b": 2.0, "c": 2.0})
+
+	nbs, _ := people.Neighbors("Chris")
+	if nbs[0].Key != "Mary" {
+		t.Error("Expected Mary to be the closest neighbor under cosine, got", nbs[0].Key)
+	}
+
+	people.SetMetric(Pearson)
+	nbs, _ = people.Neighbors("Chris")
+	if nbs[0].Key != "Jay" || nbs[1].Key != "Mary" {
+		t.Error("Unexpected similarity order under pearson")
+	}
+	if nbs[0].Distance < 0.99 {
+		t.Error("Expected Jay to correlate perfectly, got", nbs[0].Distance)
+	}
+}
+
+func TestJaccardMetric(t *testing.T) {
+	views := Table("jaccard")
+	views.Add("Chris", map[interface{}]float64{"a": 1.0, "b": 1.0, "c": 1.0})
+	views.Add("Jay", map[interface{}]float64{"a": 1.0, "b": 1.0})
+	views.Add("Mary", map[interface{}]float64{"a": 1.0, "b": 1.0, "c": 1.0,
+		"w": 1.0, "x": 1.0, "y": 1.0, "z": 1.0})
+
+	// cosine only looks at Chris' keys, so Mary's extra views don't count
+	nbs, _ := views.Neighbors("Chris")
+	if nbs[0].Key != "Mary" || nbs[1].Key != "Jay" {
+		t.Error("Unexpected similarity order under cosine")
+	}
+
+	views.SetMetric(Jaccard)
+	nbs, _ = views.Neighbors("Chris")
+	if nbs[0].Key != "Jay" || nbs[1].Key != "Mary" {
+		t.Error("Unexpected similarity order under jaccard")
+	}
+
+	recs, _ := views.Recommend("Chris", 0)
+	if len(recs) != 4 {
+		t.Error("Expected 4 recommendations, got", len(recs))
+	}
+	for _, rec := range recs {
+		if rec.Score <= 0 {
+			t.Error("Expected positive score for", rec.Key, "got", rec.Score)
+		}
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	var buf bytes.Buffer
+	books := Table("verbose")
+	books.SetLogger(StdLogger(log.New(&buf, "", 0)))
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Moby-Dick": 3.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0, "Emma": 2.0})
+
+	books.Neighbors("Chris")
+	books.Recommend("Chris", 0)
+	if buf.Len() > 0 {
+		t.Errorf("Expected no log output when not verbose, got %q", buf.String())
+	}
+
+	books.SetVerbose(true)
+	books.Neighbors("Chris")
+	if !bytes.Contains(buf.Bytes(), []byte("Found shared table=verbose dataKey=1984 score=5 otherScore=4")) {
+		t.Errorf("Expected shared key diagnostics when verbose, got %q", buf.String())
+	}
+}
+
+func TestItemNeighbors(t *testing.T) {
+	ratings := Table("itemneighbors")
+	ratings.Add("u1", map[interface{}]float64{"i1": 5.0, "i2": 3.0, "i3": 3.0, "i4": 1.0})
+	ratings.Add("u2", map[interface{}]float64{"i1": 1.0, "i2": 4.0, "i3": 4.0, "i4": 1.0})
+	ratings.Add("u3", map[interface{}]float64{"i1": 3.0, "i2": 1.0, "i3": 4.0, "i4": 2.0})
+
+	// plain cosine over the raw scores favors i4
+	columns, _ := ratings.transpose()
+	if cosineSim(columns["i1"], columns["i4"]) <= cosineSim(columns["i1"], columns["i3"]) {
+		t.Error("Expected plain cosine to rank i4 above i3")
+	}
+
+	nbs, err := ratings.ItemNeighbors("i1")
+	if err != nil {
+		t.Fatal("Error retrieving item neighbors", err)
+	}
+	if len(nbs) != 3 {
+		t.Fatal("Expected 3 item neighbors, got", len(nbs))
+	}
+	if nbs[0].Key != "i3" || nbs[1].Key != "i4" || nbs[2].Key != "i2" {
+		t.Error("Unexpected adjusted cosine order", nbs)
+	}
+
+	if _, err := ratings.ItemNeighbors("i5"); err == nil {
+		t.Error("Expected error for unknown data key")
+	}
+}
+
+func TestManhattanMetric(t *testing.T) {
+	stores := Table("manhattan")
+	stores.Add("Chris", map[interface{}]float64{"price": 3.0, "distance": 2.0})
+	stores.Add("Jay", map[interface{}]float64{"price": 4.0, "distance": 2.5, "parking": 1.0})
+	stores.Add("Mary", map[interface{}]float64{"price": 1.0, "distance": 9.0})
+	stores.Add("Jack", map[interface{}]float64{"parking": 1.0})
+
+	stores.SetMetric(Manhattan)
+	nbs, _ := stores.Neighbors("Chris")
+	if len(nbs) != 3 {
+		t.Fatal("Expected 3 neighbours, got", len(nbs))
+	}
+	if nbs[0].Key != "Jay" || nbs[1].Key != "Mary" || nbs[2].Key != "Jack" {
+		t.Error("Unexpected similarity order under manhattan")
+	}
+	for _, nb := range nbs {
+		if nb.Distance < 0 || nb.Distance > 1 {
+			t.Error("Expected similarity in [0,1], got", nb.Distance)
+		}
+	}
+	if nbs[2].Distance != 0 {
+		t.Error("Expected 0 for a neighbor without shared keys, got", nbs[2].Distance)
+	}
+}
+
+func TestNeighborsOrder(t *testing.T) {
+	books := Table("neighbors")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 1.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 1.0, "Emma": 5.0})
+
+	nbs, err := books.Neighbors("Chris")
+	if err != nil {
+		t.Fatal("Error retrieving neighbors", err)
+	}
+	if len(nbs) != 2 || nbs[0].Key != "Jay" || nbs[1].Key != "Mary" {
+		t.Error("Unexpected similarity order", nbs)
+	}
+
+	if _, err := books.Neighbors("Jack"); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+
+	books.SetDataLoader(func(key interface{}) *RegommendItem {
+		item := CreateRegommendItem(key, map[interface{}]float64{"1984": 1.0, "Emma": 5.0})
+		return &item
+	})
+	nbs, err = books.Neighbors("Jack")
+	if err != nil {
+		t.Fatal("Error retrieving neighbors of a loaded item", err)
+	}
+	if nbs[0].Key != "Mary" {
+		t.Error("Expected Mary to be the closest neighbor of Jack, got", nbs[0].Key)
+	}
+}
+
+func TestConstantSimilarityRanking(t *testing.T) {
+	books := Table("constantsimilarity")
+	books.Add("Chris", map[interface{}]float64{"a": 5.0})
+	books.Add("Jay", map[interface{}]float64{"a": 5.0, "b": 5.0, "c": 1.0})
+	books.Add("Mary", map[interface{}]float64{"a": 1.0, "b": 3.0, "d": 4.0})
+	books.SetAggregation(WeightedSum)
+
+	// every neighbor weighs the same, so scores are plain averages
+	books.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return 1.0
+	})
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 3 {
+		t.Fatal("Expected 3 recommendations, got", len(recs))
+	}
+	if recs[0].Key != "b" || recs[1].Key != "d" || recs[2].Key != "c" {
+		t.Error("Unexpected recommendation order", recs)
+	}
+	if recs[0].Score != 4.0 || recs[1].Score != 2.0 || recs[2].Score != 0.5 {
+		t.Error("Unexpected recommendation scores", recs)
+	}
+}
+
+func TestRecommendTopN(t *testing.T) {
+	books := Table("recommendtopn")
+	books.Add("Chris", map[interface{}]float64{"a": 4.0, "b": 3.0})
+	books.Add("Jay", map[interface{}]float64{"a": 4.0, "b": 3.0, "c": 5.0})
+	books.Add("Mary", map[interface{}]float64{"a": 3.0, "b": 4.0, "d": 2.0})
+	books.SetAggregation(WeightedSum)
+
+	// sim(Jay) = 1, sim(Mary) = 24 / 25 = 0.96, summing up to 1.96
+	recs, err := books.Recommend("Chris", 0)
+	if err != nil {
+		t.Fatal("Error retrieving recommendations", err)
+	}
+	if len(recs) != 2 || recs[0].Key != "c" || recs[1].Key != "d" {
+		t.Fatal("Unexpected recommendations", recs)
+	}
+	if math.Abs(recs[0].Score-5.0/1.96) > 1e-9 {
+		t.Error("Expected score 5 / 1.96 for c, got", recs[0].Score)
+	}
+	if math.Abs(recs[1].Score-2.0*0.96/1.96) > 1e-9 {
+		t.Error("Expected score 2 * 0.96 / 1.96 for d, got", recs[1].Score)
+	}
+
+	recs, _ = books.Recommend("Chris", 1)
+	if len(recs) != 1 || recs[0].Key != "c" {
+		t.Error("Expected only the top recommendation, got", recs)
+	}
+
+	if _, err := books.Recommend("Jack", 1); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestNeighborItems(t *testing.T) {
+	books := Table("neighboritems")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 1.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 1.0, "Emma": 5.0})
+
+	items, err := books.NeighborItems("Chris", 1)
+	if err != nil {
+		t.Fatal("Error retrieving neighbor items", err)
+	}
+	if len(items) != 1 || items[0].Key() != "Jay" {
+		t.Error("Expected Jay as the only neighbor item, got", items)
+	}
+
+	items, _ = books.NeighborItems("Chris", 10)
+	if len(items) != 2 || items[0].Key() != "Jay" || items[1].Key() != "Mary" {
+		t.Error("Expected all other items, got", items)
+	}
+
+	if _, err := books.NeighborItems("Jack", 1); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestNeighborItemsWithScores(t *testing.T) {
+	books := Table("neighboritemswithscores")
+	books.Add("Chris", map[interface{}]float64{"1984": 4.0, "Emma": 3.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0, "Emma": 3.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 3.0, "Emma": 4.0})
+
+	items, err := books.NeighborItemsWithScores("Chris", 0)
+	if err != nil {
+		t.Fatal("Error retrieving neighbor items", err)
+	}
+	if len(items) != 2 || items[0].Item.Key() != "Jay" || items[1].Item.Key() != "Mary" {
+		t.Fatal("Unexpected neighbor items", items)
+	}
+	if math.Abs(items[0].Score-1.0) > 1e-9 || math.Abs(items[1].Score-0.96) > 1e-9 {
+		t.Error("Unexpected neighbor scores", items[0].Score, items[1].Score)
+	}
+}
+
+func TestNeighborsN(t *testing.T) {
+	ratings := Table("neighborsn")
+	for i := 0; i < 50; i++ {
+		// plenty of ties to exercise the deterministic ordering
+		ratings.Add(i, map[interface{}]float64{"a": float64(i % 5), "b": 1.0})
+	}
+
+	all, _ := ratings.Neighbors(0)
+	for _, n := range []int{1, 7, 20, 49, 100} {
+		top, err := ratings.NeighborsN(0, n)
+		if err != nil {
+			t.Fatal("Error retrieving neighbors", err)
+		}
+		expected := all
+		if n < len(all) {
+			expected = all[:n]
+		}
+		if len(top) != len(expected) {
+			t.Fatal("Expected", len(expected), "neighbors, got", len(top))
+		}
+		for i := range top {
+			if top[i] != expected[i] {
+				t.Errorf("n=%d: expected %v at position %d, got %v", n, expected[i], i, top[i])
+			}
+		}
+	}
+}
+
+func benchmarkTable(name string, count int) *RegommendTable {
+	table := Table(name)
+	for i := 0; i < count; i++ {
+		data := make(map[interface{}]float64)
+		for j := 0; j < 10; j++ {
+			data[(i*7+j*13)%100] = float64((i+j)%5 + 1)
+		}
+		table.Add(i, data)
+	}
+
+	return table
+}
+
+func BenchmarkNeighbors(b *testing.B) {
+	table := benchmarkTable("benchneighbors", 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nbs, _ := table.Neighbors(0)
+		_ = nbs[:20]
+	}
+}
+
+func BenchmarkNeighborsN(b *testing.B) {
+	table := benchmarkTable("benchneighbors", 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.NeighborsN(0, 20)
+	}
+}
+
+func TestRecommendBatch(t *testing.T) {
+	books := Table("recommendbatch")
+	books.Add("Chris", map[interface{}]float64{"a": 4.0, "b": 3.0})
+	books.Add("Jay", map[interface{}]float64{"a": 4.0, "b": 3.0, "c": 5.0})
+	books.Add("Mary", map[interface{}]float64{"a": 3.0, "b": 4.0, "d": 2.0})
+
+	keys := []interface{}{"Chris", "Jay", "Mary", "Jack"}
+	recs, errs := books.RecommendBatch(keys, 2)
+	if len(recs) != 3 {
+		t.Error("Expected recommendations for 3 keys, got", len(recs))
+	}
+	if len(errs) != 1 || errs["Jack"] == nil {
+		t.Error("Expected an error for Jack only, got", errs)
+	}
+
+	for _, key := range keys[:3] {
+		expected, _ := books.Recommend(key, 2)
+		if len(recs[key]) != len(expected) {
+			t.Fatal("Expected", len(expected), "recommendations for", key, "got", len(recs[key]))
+		}
+		for i := range expected {
+			if recs[key][i] != expected[i] {
+				t.Error("Expected", expected[i], "for", key, "got", recs[key][i])
+			}
+		}
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	books := Table("save")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.5})
+	books.Add(42, map[interface{}]float64{7: 0.25})
+
+	var buf bytes.Buffer
+	if err := books.SaveToWriter(&buf); err != nil {
+		t.Fatal("Error saving table", err)
+	}
+
+	loaded := Table("load")
+	loaded.Add("Jack", map[interface{}]float64{"Emma": 2.0})
+	if err := loaded.LoadFromWriter(&buf); err != nil {
+		t.Fatal("Error loading table", err)
+	}
+	if loaded.Count() != 2 || loaded.Exists("Jack") {
+		t.Error("Expected loading to replace all items, got", loaded.Count())
+	}
+	p, err := loaded.Value("Chris")
+	if err != nil || p.Data()["1984"] != 5.0 || p.Data()["Emma"] != 1.5 {
+		t.Error("Unexpected data after loading", err)
+	}
+	p, err = loaded.Value(42)
+	if err != nil || p.Data()[7] != 0.25 {
+		t.Error("Unexpected data for non-string keys after loading", err)
+	}
+
+	if err := loaded.LoadFromWriter(bytes.NewBufferString("garbage")); err == nil {
+		t.Error("Expected error loading garbage")
+	}
+	if loaded.Count() != 2 {
+		t.Error("Expected a failed load to leave the table untouched")
+	}
+}
+
+func TestSimilarityShrinkage(t *testing.T) {
+	books := Table("shrinkage")
+	chris := make(map[interface{}]float64)
+	mary := make(map[interface{}]float64)
+	for i := 0; i < 20; i++ {
+		chris[i] = 3.0
+		mary[i] = 3.5
+	}
+	books.Add("Chris", chris)
+	books.Add("Jay", map[interface{}]float64{0: 3.0})
+	books.Add("Mary", mary)
+	books.SetMetric(Euclidean)
+
+	// Jay matches perfectly, but only on a single item
+	nbs, _ := books.Neighbors("Chris")
+	if nbs[0].Key != "Jay" || nbs[1].Key != "Mary" {
+		t.Error("Unexpected similarity order without shrinkage", nbs)
+	}
+
+	books.SetSimilarityShrinkage(10)
+	nbs, _ = books.Neighbors("Chris")
+	if nbs[0].Key != "Mary" || nbs[1].Key != "Jay" {
+		t.Error("Unexpected similarity order with shrinkage", nbs)
+	}
+	if math.Abs(nbs[1].Distance-1.0/11.0) > 1e-9 {
+		t.Error("Expected Jay's similarity to shrink to 1/11, got", nbs[1].Distance)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	books := Table("json")
+	books.Add("Chris", map[interface{}]float64{"1984": 0.1, "Emma": 1.0 / 3.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0})
+
+	data, err := books.MarshalJSON()
+	if err != nil {
+		t.Fatal("Error marshaling table", err)
+	}
+
+	loaded := Table("jsonloaded")
+	loaded.Add("Jay", map[interface{}]float64{"Emma": 2.0})
+	loaded.Add("Jack", map[interface{}]float64{"Emma": 2.0})
+	if err := loaded.LoadJSON(data); err != nil {
+		t.Fatal("Error loading table", err)
+	}
+	if loaded.Count() != 3 {
+		t.Error("Expected existing items to be kept, got", loaded.Count())
+	}
+	p, _ := loaded.Value("Chris")
+	if p.Data()["1984"] != 0.1 || p.Data()["Emma"] != 1.0/3.0 {
+		t.Error("Expected exact float values after loading, got", p.Data())
+	}
+	p, _ = loaded.Value("Jay")
+	if len(p.Data()) != 1 || p.Data()["1984"] != 5.0 {
+		t.Error("Expected Jay to be replaced, got", p.Data())
+	}
+
+	books.Add(42, map[interface{}]float64{"1984": 1.0})
+	if _, err := books.MarshalJSON(); err == nil {
+		t.Error("Expected error marshaling a non-string key")
+	}
+	books.Delete(42)
+	books.Add("Mary", map[interface{}]float64{7: 1.0})
+	if _, err := books.MarshalJSON(); err == nil {
+		t.Error("Expected error marshaling a non-string data key")
+	}
+}
+
+func TestMinOverlap(t *testing.T) {
+	books := Table("minoverlap")
+	books.Add("Chris", map[interface{}]float64{"a": 4.0, "b": 3.0, "c": 2.0})
+	books.Add("Jay", map[interface{}]float64{"a": 4.0, "b": 3.0, "d": 5.0})
+	books.Add("Mary", map[interface{}]float64{"a": 3.0, "e": 2.0})
+
+	nbs, _ := books.Neighbors("Chris")
+	if len(nbs) != 2 {
+		t.Error("Expected 2 neighbors without a minimum overlap, got", len(nbs))
+	}
+
+	books.SetMinOverlap(2)
+	nbs, _ = books.Neighbors("Chris")
+	if len(nbs) != 1 || nbs[0].Key != "Jay" {
+		t.Error("Expected only Jay to share enough items, got", nbs)
+	}
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 1 || recs[0].Key != "d" {
+		t.Error("Expected only Jay's items to be recommended, got", recs)
+	}
+
+	books.SetMinOverlap(3)
+	recs, err := books.Recommend("Chris", 0)
+	if err != nil || recs == nil || len(recs) != 0 {
+		t.Error("Expected an empty result without error, got", recs, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	books := Table("update")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.0})
+	old, _ := books.Value("Chris")
+	oldData := old.Data()
+
+	p, err := books.Update("Chris", map[interface{}]float64{"Emma": 4.0, "Moby-Dick": 3.0})
+	if err != nil {
+		t.Fatal("Error updating item", err)
+	}
+	data := p.Data()
+	if len(data) != 3 || data["1984"] != 5.0 || data["Emma"] != 4.0 || data["Moby-Dick"] != 3.0 {
+		t.Error("Unexpected data after update", data)
+	}
+	if oldData["Emma"] != 1.0 || len(oldData) != 2 {
+		t.Error("Expected previously returned data to stay untouched")
+	}
+
+	if _, err := books.Update("Jack", map[interface{}]float64{"Emma": 4.0}); err == nil {
+		t.Error("Expected error updating an unknown key")
+	}
+}
+
+func TestItemJSON(t *testing.T) {
+	item := CreateRegommendItem(42, map[interface{}]float64{
+		"1984":   5.0,
+		7:        0.1,
+		int64(7): 2.0,
+		uint8(3): 3.0,
+		true:     1.0,
+		2.5:      4.0,
+	})
+	item.SetMeta("segment", "students")
+	item.SetMeta("age", 23)
+
+	b, err := item.MarshalJSON()
+	if err != nil {
+		t.Fatal("Error marshaling item", err)
+	}
+
+	var decoded RegommendItem
+	if err := decoded.UnmarshalJSON(b); err != nil {
+		t.Fatal("Error unmarshaling item", err)
+	}
+	if decoded.Key() != 42 {
+		t.Errorf("Expected key 42 of type int, got %v of type %T", decoded.Key(), decoded.Key())
+	}
+	if len(decoded.Data()) != len(item.Data()) {
+		t.Fatal("Expected", len(item.Data()), "data entries, got", len(decoded.Data()))
+	}
+	for k, v := range item.Data() {
+		if decoded.Data()[k] != v {
+			t.Errorf("Expected %v for data key %v of type %T, got %v", v, k, k, decoded.Data()[k])
+		}
+	}
+	if v, _ := decoded.Meta("segment"); v != "students" {
+		t.Error("Expected segment metadata to be restored, got", v)
+	}
+	if v, _ := decoded.Meta("age"); v != 23.0 {
+		t.Error("Expected age metadata to be restored as float64, got", v)
+	}
+
+	unsupported := CreateRegommendItem(struct{}{}, map[interface{}]float64{})
+	if _, err := unsupported.MarshalJSON(); err == nil {
+		t.Error("Expected error marshaling an unsupported key type")
+	}
+}
+
+func TestRecommendTies(t *testing.T) {
+	books := Table("recommendties")
+	books.Add("Chris", map[interface{}]float64{"a": 1.0})
+	books.Add("Jay", map[interface{}]float64{"a": 1.0, "d": 2.0, "c": 2.0, "b": 2.0, "e": 1.0})
+
+	for i := 0; i < 10; i++ {
+		recs, _ := books.Recommend("Chris", 2)
+		if len(recs) != 2 || recs[0].Key != "b" || recs[1].Key != "c" {
+			t.Fatal("Expected ties to be broken by key, got", recs)
+		}
+	}
+}
+
+func benchmarkCatalog(name string) *RegommendTable {
+	table := Table(name)
+	for i := 0; i < 50; i++ {
+		data := make(map[interface{}]float64)
+		for j := 0; j < 5000; j++ {
+			data[(i*7919+j*104729)%200000] = float64((i+j)%5 + 1)
+		}
+		table.Add(i, data)
+	}
+
+	return table
+}
+
+func BenchmarkRecommendAll(b *testing.B) {
+	table := benchmarkCatalog("benchcatalog")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recs, _ := table.Recommend(0, 0)
+		_ = recs[:20]
+	}
+}
+
+func BenchmarkRecommendTopN(b *testing.B) {
+	table := benchmarkCatalog("benchcatalog")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.Recommend(0, 20)
+	}
+}
+
+func BenchmarkPredictScore(b *testing.B) {
+	table := benchmarkCatalog("benchcatalog")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.PredictScore(0, 7919)
+	}
+}
+
+func TestAddOrUpdate(t *testing.T) {
+	books := Table("addorupdate")
+	added := 0
+	books.SetAddedItemCallback(func(item *RegommendItem) {
+		added++
+	})
+
+	p := books.AddOrUpdate("Chris", map[interface{}]float64{"1984": 5.0})
+	if added != 1 {
+		t.Error("Expected the callback to fire on create, fired", added)
+	}
+	if p.Data()["1984"] != 5.0 {
+		t.Error("Unexpected data after create", p.Data())
+	}
+
+	p = books.AddOrUpdate("Chris", map[interface{}]float64{"Emma": 2.0})
+	if added != 1 {
+		t.Error("Expected the callback not to fire on update, fired", added)
+	}
+	if len(p.Data()) != 2 || p.Data()["1984"] != 5.0 || p.Data()["Emma"] != 2.0 {
+		t.Error("Unexpected data after update", p.Data())
+	}
+	if books.Count() != 1 {
+		t.Error("Expected a single item, got", books.Count())
+	}
+}
+
+func TestSaveToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regommend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "books.json")
+
+	books := Table("savetofile")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.5})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	if err := books.SaveToFile(path); err != nil {
+		t.Fatal("Error saving table", err)
+	}
+
+	loaded := Table("loadfromfile")
+	loaded.Add("Jack", map[interface{}]float64{"Emma": 2.0})
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatal("Error loading table", err)
+	}
+	if loaded.Count() != 2 || loaded.Exists("Jack") {
+		t.Error("Expected loading to replace all items, got", loaded.Count())
+	}
+	if loaded.name != "loadfromfile" {
+		t.Error("Expected a named table to keep its name, got", loaded.name)
+	}
+	p, _ := loaded.Value("Chris")
+	if p.Data()["Emma"] != 1.5 {
+		t.Error("Unexpected data after loading", p.Data())
+	}
+
+	var unnamed RegommendTable
+	if err := unnamed.LoadFromFile(path); err != nil {
+		t.Fatal("Error loading table", err)
+	}
+	if unnamed.name != "savetofile" || unnamed.Count() != 2 {
+		t.Error("Expected an unnamed table to take over the stored name")
+	}
+
+	if err := loaded.LoadFromFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected error loading a missing file")
+	}
+}
+
+func TestRecommendExclude(t *testing.T) {
+	books := Table("recommendexclude")
+	books.Add("Chris", map[interface{}]float64{"a": 1.0})
+	books.Add("Jay", map[interface{}]float64{"a": 1.0, "b": 4.0, "c": 3.0, "d": 2.0, "e": 1.0})
+
+	recs, _ := books.Recommend("Chris", 2, Exclude(map[interface{}]bool{"b": true, "a": true}))
+	if len(recs) != 2 || recs[0].Key != "c" || recs[1].Key != "d" {
+		t.Error("Expected excluded keys to be skipped before truncation, got", recs)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	books := Table("keys")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	books.Add(42, map[interface{}]float64{"1984": 3.0})
+
+	keys := books.Keys()
+	if len(keys) != 3 {
+		t.Fatal("Expected 3 keys, got", len(keys))
+	}
+	found := make(map[interface{}]bool)
+	for _, k := range keys {
+		found[k] = true
+	}
+	if !found["Chris"] || !found["Jay"] || !found[42] {
+		t.Error("Unexpected keys", keys)
+	}
+}
+
+func TestGob(t *testing.T) {
+	books := Table("gob")
+	for i := 0; i < 10000; i++ {
+		books.Add(i, map[interface{}]float64{"a": float64(i), i % 7: 0.5, "z": 1.0 / float64(i+1)})
+	}
+
+	b, err := books.GobEncode()
+	if err != nil {
+		t.Fatal("Error encoding table", err)
+	}
+	again, _ := books.GobEncode()
+	if !bytes.Equal(b, again) {
+		t.Error("Expected a deterministic encoding")
+	}
+
+	var decoded RegommendTable
+	if err := decoded.GobDecode(b); err != nil {
+		t.Fatal("Error decoding table", err)
+	}
+	if decoded.name != "gob" || decoded.Count() != 10000 {
+		t.Fatal("Unexpected table after decoding", decoded.name, decoded.Count())
+	}
+	for i := 0; i < 10000; i++ {
+		p, err := decoded.Value(i)
+		if err != nil {
+			t.Fatal("Error retrieving decoded item", err)
+		}
+		expected, _ := books.Value(i)
+		if len(p.Data()) != len(expected.Data()) {
+			t.Fatal("Unexpected data for", i, p.Data())
+		}
+		for k, v := range expected.Data() {
+			if p.Data()[k] != v {
+				t.Fatal("Unexpected data for", i, p.Data())
+			}
+		}
+	}
+}
+
+func TestNeighborsPage(t *testing.T) {
+	people := Table("neighborspage")
+	people.Add("Chris", map[interface{}]float64{"a": 1.0})
+	// a, b and c tie, spanning the boundary between the first two pages
+	for _, key := range []string{"c", "b", "a", "d", "e"} {
+		people.Add(key, map[interface{}]float64{"a": 1.0})
+	}
+	people.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return 1.0
+	})
+
+	all, _ := people.Neighbors("Chris")
+	seen := DistancePairList{}
+	cursor := ""
+	for i := 0; ; i++ {
+		page, next, err := people.NeighborsPage("Chris", cursor, 2)
+		if err != nil {
+			t.Fatal("Error retrieving page", err)
+		}
+		seen = append(seen, page...)
+		if next == "" {
+			break
+		}
+		if i > 5 {
+			t.Fatal("Expected paging to end")
+		}
+		cursor = next
+	}
+	if len(seen) != len(all) {
+		t.Fatal("Expected", len(all), "neighbors over all pages, got", len(seen))
+	}
+	for i := range all {
+		if seen[i] != all[i] {
+			t.Error("Expected", all[i], "at position", i, "got", seen[i])
+		}
+	}
+
+	// page past the end
+	_, cursor, _ = people.NeighborsPage("Chris", "", 10)
+	if cursor != "" {
+		t.Error("Expected no cursor after the last page, got", cursor)
+	}
+	past := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%s", people.version, 100, cursorKey("Chris"))))
+	page, next, err := people.NeighborsPage("Chris", past, 2)
+	if err != nil || len(page) != 0 || next != "" {
+		t.Error("Expected an empty page without error past the end, got", page, next, err)
+	}
+
+	if _, _, err := people.NeighborsPage("Chris", "garbage!", 2); err != ErrInvalidCursor {
+		t.Error("Expected ErrInvalidCursor, got", err)
+	}
+
+	// cursors only work for the key they were returned for
+	_, cursor, _ = people.NeighborsPage("Chris", "", 2)
+	if _, _, err := people.NeighborsPage("a", cursor, 2); err != ErrInvalidCursor {
+		t.Error("Expected ErrInvalidCursor for another key, got", err)
+	}
+	_, other, _ := people.NeighborsPage("a", "", 2)
+	if len(people.pages) != 2 {
+		t.Error("Expected rankings to be kept for both keys, got", len(people.pages))
+	}
+	if _, _, err := people.NeighborsPage("Chris", cursor, 2); err != nil {
+		t.Error("Expected paging Chris to go on, got", err)
+	}
+	if _, _, err := people.NeighborsPage("a", other, 2); err != nil {
+		t.Error("Expected paging a to go on, got", err)
+	}
+
+	_, cursor, _ = people.NeighborsPage("Chris", "", 2)
+	people.Add("f", map[interface{}]float64{"a": 1.0})
+	if _, _, err := people.NeighborsPage("Chris", cursor, 2); err != ErrStaleCursor {
+		t.Error("Expected ErrStaleCursor, got", err)
+	}
+}
+
+func TestForeach(t *testing.T) {
+	books := Table("foreach")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	books.Add("Mary", map[interface{}]float64{"Emma": 3.0})
+
+	count := 0
+	sum := 0.0
+	books.Foreach(func(key interface{}, item *RegommendItem) {
+		count++
+		for _, v := range item.Data() {
+			sum += v
+		}
+	})
+	if count != 3 {
+		t.Error("Expected to visit 3 items, visited", count)
+	}
+	if sum != 13.0 {
+		t.Error("Expected a sum of 13, got", sum)
+	}
+}
+
+func TestLoadFromCSV(t *testing.T) {
+	books := Table("loadfromcsv")
+	csv := "5.0,Chris,1984\n4.5,Jay,1984\n1.0,Chris,Emma\n"
+	if err := books.LoadFromCSV(strings.NewReader(csv), 1, 0); err != nil {
+		t.Fatal("Error loading CSV", err)
+	}
+	if books.Count() != 2 {
+		t.Error("Expected 2 items, got", books.Count())
+	}
+	p, _ := books.Value("Chris")
+	if len(p.Data()) != 2 || p.Data()["1984"] != 5.0 || p.Data()["Emma"] != 1.0 {
+		t.Error("Unexpected data after loading", p.Data())
+	}
+
+	err := books.LoadFromCSV(strings.NewReader("Mary,1984,4\nMary,Emma,great\n"), 0, 2)
+	if err == nil || !strings.Contains(err.Error(), "Line 2") {
+		t.Error("Expected error mentioning line 2, got", err)
+	}
+	if books.Exists("Mary") {
+		t.Error("Expected nothing to be added from invalid CSV")
+	}
+
+	if err := books.LoadFromCSV(strings.NewReader(csv), -1, 0); err == nil {
+		t.Error("Expected error for a negative key column")
+	}
+	if err := books.LoadFromCSV(strings.NewReader(csv), 1, 1); err == nil {
+		t.Error("Expected error for identical key and score columns")
+	}
+}
+
+func TestLoadCSV(t *testing.T) {
+	books := Table("loadcsv")
+	books.Add("Chris", map[interface{}]float64{"Dune": 3.0})
+	csv := "user,item,rating\nChris,1984,5.0\nJay,1984,4.5\nChris,Emma,1.0\n"
+	if err := books.LoadCSV(strings.NewReader(csv)); err != nil {
+		t.Fatal("Error loading CSV", err)
+	}
+	if books.Count() != 2 {
+		t.Error("Expected 2 items, got", books.Count())
+	}
+	p, _ := books.Value("Chris")
+	if len(p.Data()) != 3 || p.Data()["1984"] != 5.0 || p.Data()["Dune"] != 3.0 {
+		t.Error("Expected CSV to be merged into existing data, got", p.Data())
+	}
+
+	// reads what SaveCSV writes
+	var buf bytes.Buffer
+	books.SaveCSV(&buf)
+	copied := Table("loadcsvcopy")
+	if err := copied.LoadCSV(&buf); err != nil || copied.Count() != 2 {
+		t.Error("Expected to load dumped CSV, got", copied.Count(), err)
+	}
+
+	err := books.LoadCSV(strings.NewReader("Mary,1984,4\nMary,Emma,great\n"))
+	if err == nil || !strings.Contains(err.Error(), "Line 2") {
+		t.Error("Expected error mentioning line 2, got", err)
+	}
+	if books.Exists("Mary") {
+		t.Error("Expected nothing to be added from invalid CSV")
+	}
+}
+
+func TestSaveCSV(t *testing.T) {
+	books := Table("savecsv")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 1.0 / 3.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.5, "Dune": 1e-12})
+
+	var buf bytes.Buffer
+	if err := books.SaveCSV(&buf); err != nil {
+		t.Fatal("Error saving CSV", err)
+	}
+	saved := buf.String()
+	if !strings.HasPrefix(saved, "key,dataKey,value\nChris,1984,5\n") {
+		t.Error("Expected sorted rows after a header, got", saved)
+	}
+
+	loaded := Table("savecsvloaded")
+	if err := loaded.LoadCSV(strings.NewReader(saved)); err != nil {
+		t.Fatal("Error loading saved CSV", err)
+	}
+	if loaded.Count() != books.Count() {
+		t.Fatal("Expected", books.Count(), "items, got", loaded.Count())
+	}
+	for _, k := range books.Keys() {
+		expected, _ := books.Value(k)
+		p, err := loaded.Value(k)
+		if err != nil || len(p.Data()) != len(expected.Data()) {
+			t.Fatal("Expected item", k, "to be loaded, got", p, err)
+		}
+		for dk, v := range expected.Data() {
+			if p.Data()[dk] != v {
+				t.Error("Expected", k, dk, "to be", v, "got", p.Data()[dk])
+			}
+		}
+	}
+}
+
+func TestRecommendMinScore(t *testing.T) {
+	books := Table("recommendminscore")
+	books.Add("Chris", map[interface{}]float64{"a": 1.0})
+	books.Add("Jay", map[interface{}]float64{"a": 1.0, "b": 4.0, "c": 3.0, "d": 0.5})
+
+	recs, _ := books.Recommend("Chris", 0, MinScore(1.0))
+	if len(recs) != 2 || recs[0].Key != "b" || recs[1].Key != "c" {
+		t.Error("Expected d to fall below the threshold, got", recs)
+	}
+
+	recs, _ = books.Recommend("Chris", 0)
+	if len(recs) != 3 {
+		t.Error("Expected all recommendations without a threshold, got", recs)
+	}
+}
+
+func TestDumpToCSV(t *testing.T) {
+	books := Table("dumptocsv")
+	books.Add("Jay", map[interface{}]float64{"Emma": 4.5})
+	books.Add("Chris", map[interface{}]float64{"Emma": 0.1, "1984": 5.0})
+
+	var buf bytes.Buffer
+	if err := books.DumpToCSV(&buf); err != nil {
+		t.Fatal("Error dumping CSV", err)
+	}
+	expected := "key,dataKey,value\nChris,1984,5\nChris,Emma,0.1\nJay,Emma,4.5\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestValueKeepsAlive(t *testing.T) {
+	books := Table("keepalive")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+
+	p, _ := books.Value("Chris")
+	count := p.AccessCount()
+	accessed := p.AccessedOn()
+	for i := 1; i <= 3; i++ {
+		books.Value("Chris")
+		if p.AccessCount() != count+int64(i) {
+			t.Error("Expected access count", count+int64(i), "got", p.AccessCount())
+		}
+	}
+	if p.AccessedOn().Before(accessed) {
+		t.Error("Expected access time to advance")
+	}
+
+	if books.Exists("Chris"); p.AccessCount() != count+3 {
+		t.Error("Expected Exists not to count as an access")
+	}
+
+	books.Recommend("Chris", 0)
+	if p.AccessCount() != count+4 {
+		t.Error("Expected Recommend to count as an access")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	books := New("keepaliveexplicit")
+	defer books.StopTTL()
+	item := books.AddWithTTL("Chris", map[interface{}]float64{"1984": 5.0}, 50*time.Millisecond)
+	created := item.CreatedOn()
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		item.KeepAlive()
+	}
+	if !books.Exists("Chris") {
+		t.Error("Expected KeepAlive to keep Chris from expiring")
+	}
+	if item.CreatedOn() != created || !item.AccessedOn().After(created) {
+		t.Error("Expected access time to advance, creation time not to")
+	}
+	if item.AccessCount() != 4 {
+		t.Error("Expected access count of 4, got", item.AccessCount())
+	}
+}
+
+func TestReplacedItemAccess(t *testing.T) {
+	books := New("replacedaccess")
+	old := books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Chris", map[interface{}]float64{"Emma": 4.0})
+	old.KeepAlive()
+	if old.AccessCount() != 0 {
+		t.Error("Expected accesses to a replaced item not to count, got", old.AccessCount())
+	}
+
+	b, err := books.MarshalJSON()
+	if err != nil {
+		t.Fatal("Error marshaling table", err)
+	}
+	old, _ = books.Value("Chris")
+	if err := books.UnmarshalJSON(b); err != nil {
+		t.Fatal("Error unmarshaling table", err)
+	}
+	if old.KeepAlive(); old.AccessCount() != 0 {
+		t.Error("Expected unmarshaling to reset the access count of replaced items")
+	}
+
+	b, err = books.GobEncode()
+	if err != nil {
+		t.Fatal("Error encoding table", err)
+	}
+	old, _ = books.Value("Chris")
+	if err := books.GobDecode(b); err != nil {
+		t.Fatal("Error decoding table", err)
+	}
+	if old.KeepAlive(); old.AccessCount() != 0 {
+		t.Error("Expected decoding to reset the access count of replaced items")
+	}
+}
+
+func TestRecommendForProfile(t *testing.T) {
+	books := Table("recommendforprofile")
+	books.Add("Jay", map[interface{}]float64{"a": 4.0, "b": 3.0, "c": 5.0})
+	books.Add("Mary", map[interface{}]float64{"a": 3.0, "b": 4.0, "d": 2.0})
+	jay, _ := books.Value("Jay")
+	count := jay.AccessCount()
+
+	profile := map[interface{}]float64{"a": 4.0, "b": 3.0}
+	recs := books.RecommendForProfile(profile, 0)
+	if len(recs) != 2 || recs[0].Key != "c" || recs[1].Key != "d" {
+		t.Error("Unexpected recommendations for profile", recs)
+	}
+
+	// same result as for a stored item with that profile
+	books.Add("Chris", profile)
+	expected, _ := books.Recommend("Chris", 0)
+	books.Delete("Chris")
+	for i := range expected {
+		if recs[i] != expected[i] {
+			t.Error("Expected", expected[i], "got", recs[i])
+		}
+	}
+
+	if books.Count() != 2 || jay.AccessCount() != count {
+		t.Error("Expected the engine to stay untouched")
+	}
+}
+
+func TestAddOrUpdateConcurrent(t *testing.T) {
+	books := Table("addorupdateconcurrent")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			books.AddOrUpdate("Chris", map[interface{}]float64{i: float64(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	p, _ := books.Value("Chris")
+	if len(p.Data()) != 50 {
+		t.Error("Expected all 50 ratings to be merged, got", len(p.Data()))
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	books := Table("timestamps")
+	before := time.Now()
+	p := books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	after := time.Now()
+
+	created := p.CreatedOn()
+	if created.Before(before) || created.After(after) {
+		t.Error("Expected creation time between", before, "and", after, "got", created)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	books.Value("Chris")
+	accessed := p.AccessedOn()
+	if !accessed.After(created) {
+		t.Error("Expected access time to advance after Value")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	books.Update("Chris", map[interface{}]float64{"Emma": 1.0})
+	if !p.AccessedOn().After(accessed) {
+		t.Error("Expected access time to advance after Update")
+	}
+	if p.CreatedOn() != created {
+		t.Error("Expected creation time to stay the same")
+	}
+}
+
+func TestRecommendBatchWorkers(t *testing.T) {
+	table := benchmarkTable("recommendbatchworkers", 100)
+	keys := table.Keys()
+
+	expected, _ := table.RecommendBatch(keys, 5)
+	table.SetWorkers(1)
+	recs, errs := table.RecommendBatch(keys, 5)
+	if len(errs) != 0 || len(recs) != len(expected) {
+		t.Fatal("Expected recommendations for all keys, got", len(recs), errs)
+	}
+	for key, r := range recs {
+		for i := range r {
+			if r[i] != expected[key][i] {
+				t.Error("Expected", expected[key][i], "for", key, "got", r[i])
+			}
+		}
+	}
+}
+
+func BenchmarkRecommendLoop(b *testing.B) {
+	table := benchmarkTable("benchbatch", 2000)
+	keys := table.Keys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			table.Recommend(key, 10)
+		}
+	}
+}
+
+func BenchmarkRecommendBatch(b *testing.B) {
+	table := benchmarkTable("benchbatch", 2000)
+	keys := table.Keys()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.RecommendBatch(keys, 10)
+	}
+}
+
+func TestIncrementRating(t *testing.T) {
+	books := Table("incrementrating")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			books.IncrementRating("Chris", "1984", 0.5)
+		}()
+	}
+	wg.Wait()
+
+	p, err := books.Value("Chris")
+	if err != nil {
+		t.Fatal("Error retrieving created item", err)
+	}
+	if p.Data()["1984"] != 25 {
+		t.Error("Expected all increments to be summed up, got", p.Data()["1984"])
+	}
+
+	books.IncrementRating("Chris", "Brave New World", -1)
+	if p.Data()["Brave New World"] != -1 || len(p.Data()) != 2 {
+		t.Error("Expected missing rating to count as 0, got", p.Data())
+	}
+
+	if err := books.IncrementRating("Chris", "1984", math.NaN()); err == nil {
+		t.Error("Expected error for NaN delta")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	books := Table("ttl")
+	deleted := make(chan interface{}, 1)
+	books.SetExpiredItemCallback(func(item *RegommendItem) {
+		deleted <- item.Key()
+	})
+
+	books.SetTTL(20 * time.Millisecond)
+	defer books.StopTTL()
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+
+	select {
+	case key := <-deleted:
+		if key != "Chris" {
+			t.Error("Expected expired item to be Chris, got", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected expired callback to fire for expired item")
+	}
+	if books.Count() != 0 {
+		t.Error("Expected expired item to be removed, count is", books.Count())
+	}
+
+	books.StopTTL()
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	time.Sleep(50 * time.Millisecond)
+	if books.Count() != 1 {
+		t.Error("Expected no expiration after StopTTL, count is", books.Count())
+	}
+}
+
+func TestRecommendItemBased(t *testing.T) {
+	ratings := Table("recommenditembased")
+	ratings.Add("u1", map[interface{}]float64{"i1": 5.0, "i2": 4.0, "i3": 1.0})
+	ratings.Add("u2", map[interface{}]float64{"i1": 4.0, "i2": 5.0, "i3": 2.0, "i4": 5.0, "i5": 1.0})
+	ratings.Add("u3", map[interface{}]float64{"i1": 1.0, "i2": 2.0, "i3": 5.0, "i4": 1.0, "i5": 5.0})
+	ratings.Add("u4", map[interface{}]float64{"i1": 5.0, "i4": 4.0, "i6": 5.0})
+
+	ratings.SetAggregation(WeightedSum)
+	ub, _ := ratings.Recommend("u1", 0)
+	ib, err := ratings.RecommendItemBased("u1", 0)
+	if err != nil {
+		t.Fatal("Error retrieving item-based recommendations", err)
+	}
+	if len(ub) != 3 || len(ib) != 3 {
+		t.Fatal("Expected 3 recommendations from both modes, got", ub, ib)
+	}
+
+	// both modes agree u1 won't like what u3 likes
+	if ub[2].Key != "i5" || ib[2].Key != "i5" {
+		t.Error("Expected both modes to rank i5 last, got", ub, ib)
+	}
+	// only u4 scored i6, not much like u1, but it scored i6 just like i1
+	if ub[0].Key != "i4" {
+		t.Error("Expected user-based mode to favor i4, got", ub)
+	}
+	if ib[0].Key != "i6" || ib[0].Score != 5.0 {
+		t.Error("Expected item-based mode to favor i6, got", ib)
+	}
+
+	// the transposed view gets rebuilt once the table changes
+	columns, _ := ratings.transpose()
+	if _, ok := columns["i7"]; ok {
+		t.Error("Expected no column for unknown data key")
+	}
+	ratings.Add("u5", map[interface{}]float64{"i7": 3.0})
+	columns, _ = ratings.transpose()
+	if _, ok := columns["i7"]; !ok {
+		t.Error("Expected transposed view to be rebuilt after Add")
+	}
+
+	if _, err := ratings.RecommendItemBased("u6", 0); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestRecommendExplained(t *testing.T) {
+	books := Table("recommendexplained")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Robinson Crusoe": 4.0, "Moby-Dick": 3.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Robinson Crusoe": 4.0, "Gulliver's Travels": 4.5})
+	books.Add("Mary", map[interface{}]float64{"1984": 4.0, "Robinson Crusoe": 3.0, "Gulliver's Travels": 4.5, "Emma": 2.0})
+	books.Add("Jack", map[interface{}]float64{"1984": 3.0, "Robinson Crusoe": 1.0})
+
+	recs, _ := books.Recommend("Chris", 0)
+	explained, err := books.RecommendExplained("Chris", 0)
+	if err != nil {
+		t.Fatal("Error retrieving explained recommendations", err)
+	}
+	if len(explained) != len(recs) {
+		t.Fatal("Expected as many explained recommendations as plain ones, got", len(explained))
+	}
+
+	for i, r := range explained {
+		if r.Recommendation != recs[i] {
+			t.Error("Expected explained recommendation to match plain one, got", r.Recommendation, recs[i])
+		}
+		sum := 0.0
+		for _, c := range r.Contributors {
+			sum += c.Contribution
+		}
+		if math.Abs(sum-r.Score) > 1e-9 {
+			t.Error("Expected contributions to add up to the score, got", sum, r.Score)
+		}
+	}
+
+	gulliver := explained[0]
+	if gulliver.Key != "Gulliver's Travels" || len(gulliver.Contributors) != 2 {
+		t.Fatal("Expected Gulliver's Travels to be explained by 2 neighbors, got", gulliver)
+	}
+	c := gulliver.Contributors[0]
+	if c.Key != "Jay" || c.Score != 4.5 || c.Similarity <= gulliver.Contributors[1].Similarity {
+		t.Error("Expected Jay to contribute the most, got", gulliver.Contributors)
+	}
+
+	explained, _ = books.RecommendExplained("Chris", 1, ExplainLimit(1))
+	if len(explained) != 1 || len(explained[0].Contributors) != 1 || explained[0].Contributors[0] != c {
+		t.Error("Expected only the top contributor, got", explained)
+	}
+	books.Add("Tina", map[interface{}]float64{"1984": 5.0, "Robinson Crusoe": 3.0, "Gulliver's Travels": 4.0})
+	books.Add("Paul", map[interface{}]float64{"1984": 4.0, "Robinson Crusoe": 4.0, "Gulliver's Travels": 3.0})
+	explained, _ = books.RecommendExplained("Chris", 1)
+	if len(explained[0].Contributors) != 3 {
+		t.Error("Expected 3 contributors by default, got", explained[0].Contributors)
+	}
+	explained, _ = books.RecommendExplained("Chris", 1, ExplainLimit(0))
+	if len(explained[0].Contributors) != 4 {
+		t.Error("Expected all 4 contributors, got", explained[0].Contributors)
+	}
+
+	if _, err := books.RecommendExplained("Tom", 0); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestAssumeNormalized(t *testing.T) {
+	people := Table("assumenormalized")
+	people.Add("Chris", map[interface{}]float64{"a": 0.6, "b": 0.8})
+	people.Add("Jay", map[interface{}]float64{"a": 0.8, "b": 0.6})
+	people.Add("Mary", map[interface{}]float64{"a": 1.0})
+
+	people.SetAssumeNormalized(true)
+	nbs, _ := people.Neighbors("Chris")
+	if len(nbs) != 2 || nbs[0].Key != "Jay" || math.Abs(nbs[0].Distance-0.96) > 1e-9 {
+		t.Fatal("Unexpected neighbors for normalized items", nbs)
+	}
+	if math.Abs(nbs[1].Distance-0.6) > 1e-9 {
+		t.Error("Expected dot product of 0.6 with Mary, got", nbs[1].Distance)
+	}
+
+	// the cached norm must not survive an update
+	people.Update("Mary", map[interface{}]float64{"b": 1.0})
+	nbs, _ = people.Neighbors("Chris")
+	if nbs[0].Key != "Mary" || math.Abs(nbs[0].Distance-1.4/math.Sqrt(2)) > 1e-9 {
+		t.Error("Expected Mary's norm to be recomputed, got", nbs)
+	}
+}
+
+func BenchmarkNeighborsCosine(b *testing.B) {
+	table := benchmarkTable("benchcosine", 5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.NeighborsN(0, 20)
+	}
+}
+
+func BenchmarkNeighborsNormalized(b *testing.B) {
+	table := benchmarkTable("benchnormalized", 5000)
+	table.SetAssumeNormalized(true)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.NeighborsN(0, 20)
+	}
+}
+
+func TestAddWithTTL(t *testing.T) {
+	books := Table("addwithttl")
+	defer books.StopTTL()
+	deleted := make(chan interface{}, 2)
+	books.SetExpiredItemCallback(func(item *RegommendItem) {
+		deleted <- item.Key()
+	})
+
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	item := books.AddWithTTL("Jay", map[interface{}]float64{"1984": 4.0}, 20*time.Millisecond)
+	if item.LifeSpan() != 20*time.Millisecond {
+		t.Error("Expected life span of 20ms, got", item.LifeSpan())
+	}
+
+	select {
+	case key := <-deleted:
+		if key != "Jay" {
+			t.Error("Expected expired item to be Jay, got", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected expired callback to fire for expired item")
+	}
+	if !books.Exists("Chris") || books.Exists("Jay") {
+		t.Error("Expected only the item with a TTL to expire")
+	}
+
+	books.SetDefaultTTL(20 * time.Millisecond)
+	books.Add("Mary", map[interface{}]float64{"1984": 3.0})
+	select {
+	case key := <-deleted:
+		if key != "Mary" {
+			t.Error("Expected expired item to be Mary, got", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected item added with default TTL to expire")
+	}
+	if books.Count() != 1 {
+		t.Error("Expected Chris to remain, count is", books.Count())
+	}
+}
+
+func TestExpiredItemCallback(t *testing.T) {
+	books := Table("expireditemcallback")
+	defer books.StopTTL()
+	deleted := make(chan interface{}, 2)
+	expired := make(chan interface{}, 2)
+	books.SetAboutToDeleteItemCallback(func(item *RegommendItem) {
+		deleted <- item.Key()
+	})
+	books.SetExpiredItemCallback(func(item *RegommendItem) {
+		expired <- item.Key()
+	})
+
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.AddWithTTL("Jay", map[interface{}]float64{"1984": 4.0}, 20*time.Millisecond)
+	books.Delete("Chris")
+
+	select {
+	case key := <-expired:
+		if key != "Jay" {
+			t.Error("Expected expired item to be Jay, got", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected expired callback to fire")
+	}
+	if len(deleted) != 1 || <-deleted != "Chris" {
+		t.Error("Expected delete callback to fire for Chris only")
+	}
+	if len(expired) != 0 {
+		t.Error("Expected expired callback to fire for Jay only")
+	}
+}
+
+func TestSimilarityCache(t *testing.T) {
+	books := Table("similaritycache")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Robinson Crusoe": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Robinson Crusoe": 4.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 1.0, "Emma": 5.0})
+	books.SetSimilarityCache(true)
+
+	first, _ := books.Neighbors("Chris")
+	if books.simCache.len() != 2 {
+		t.Fatal("Expected 2 cached similarities, got", books.simCache.len())
+	}
+	second, _ := books.Neighbors("Chris")
+	if len(first) != len(second) {
+		t.Fatal("Expected cached neighbors to match, got", first, second)
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Error("Expected cached neighbors to match, got", first, second)
+		}
+	}
+
+	// updating Jay drops its cached similarities only
+	books.Neighbors("Mary")
+	books.Update("Jay", map[interface{}]float64{"1984": 1.0, "Robinson Crusoe": 1.0, "Emma": 5.0})
+	if books.simCache.len() != 2 {
+		t.Error("Expected 2 similarities to remain cached, got", books.simCache.len())
+	}
+	nbs, _ := books.Neighbors("Chris")
+	if nbs[0].Key != "Jay" || nbs[0].Distance == first[0].Distance {
+		t.Error("Expected Jay's similarity to be recomputed, got", nbs)
+	}
+
+	books.SetSimilarityCacheSize(1)
+	books.Neighbors("Chris")
+	if books.simCache.len() != 1 {
+		t.Error("Expected cache to be bounded to 1 entry, got", books.simCache.len())
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	books := Table("aggregation")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0, "Popular": 3.0, "Niche": 5.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 4.0, "Emma": 4.0, "Popular": 3.0})
+	books.Add("Jack", map[interface{}]float64{"1984": 5.0, "Emma": 3.0, "Popular": 3.0})
+
+	books.SetAggregation(WeightedSum)
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 2 || recs[0].Key != "Popular" {
+		t.Error("Expected weighted sum to favor the popular book, got", recs)
+	}
+
+	books.SetAggregation(WeightedAverage)
+	recs, _ = books.Recommend("Chris", 0)
+	if len(recs) != 2 || recs[0].Key != "Niche" {
+		t.Fatal("Expected weighted average to favor the niche book, got", recs)
+	}
+	if math.Abs(recs[0].Score-5.0) > 1e-9 || math.Abs(recs[1].Score-3.0) > 1e-9 {
+		t.Error("Expected weighted average to predict the scores, got", recs)
+	}
+
+	explained, _ := books.RecommendExplained("Chris", 0)
+	sum := 0.0
+	for _, c := range explained[1].Contributors {
+		sum += c.Contribution
+	}
+	if math.Abs(sum-explained[1].Score) > 1e-9 {
+		t.Error("Expected contributions to add up to the averaged score, got", sum)
+	}
+}
+
+func TestNew(t *testing.T) {
+	var out bytes.Buffer
+	added := 0
+	books := New("new",
+		WithLogger(StdLogger(log.New(&out, "", 0))),
+		WithMetric(Jaccard),
+		WithDefaultTTL(time.Hour),
+		WithAddedItemCallback(func(item *RegommendItem) {
+			added++
+		}),
+	)
+	defer books.StopTTL()
+
+	item := books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 1.0, "Dune": 2.0})
+	if added != 2 {
+		t.Error("Expected added-item callback to fire twice, got", added)
+	}
+	if item.LifeSpan() != time.Hour {
+		t.Error("Expected default TTL to apply, got", item.LifeSpan())
+	}
+
+	nbs, _ := books.Neighbors("Chris")
+	if len(nbs) != 1 || math.Abs(nbs[0].Distance-1.0/3.0) > 1e-9 {
+		t.Error("Expected Jaccard similarity of 1/3, got", nbs)
+	}
+
+	books.Flush()
+	if !strings.Contains(out.String(), "Flushing table table=new items=2") {
+		t.Error("Expected flush to be logged, got", out.String())
+	}
+
+	if Table("new") == books {
+		t.Error("Expected table created by New not to be registered")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	books := Table("normalize")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0, "Popular": 3.0, "Niche": 5.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 4.0, "Emma": 4.0, "Popular": 3.0})
+
+	raw, _ := books.Recommend("Chris", 0)
+	recs, _ := books.Recommend("Chris", 0, Normalize(NormalizeRatingScale))
+	if len(recs) != 2 || recs[0].Key != "Niche" || math.Abs(recs[0].Score-5.0) > 1e-9 || math.Abs(recs[1].Score-3.0) > 1e-9 {
+		t.Fatal("Expected scores on the original scale, got", recs)
+	}
+	for _, r := range recs {
+		for _, v := range raw {
+			if v.Key == r.Key && v.Score != r.Raw {
+				t.Error("Expected raw score to be kept, got", r.Raw, v.Score)
+			}
+		}
+	}
+
+	recs, _ = books.Recommend("Chris", 0, Normalize(NormalizeMinMax))
+	if len(recs) != 2 || recs[0].Score != 1 || recs[1].Score != 0 || recs[0].Raw != raw[0].Score {
+		t.Error("Expected scores scaled to [0, 1], got", recs)
+	}
+
+	// neither a single recommendation nor equal scores divide by zero
+	recs, _ = books.Recommend("Chris", 1, Normalize(NormalizeMinMax))
+	if len(recs) != 1 || recs[0].Score != 1 {
+		t.Error("Expected single recommendation to score 1, got", recs)
+	}
+	books.Add("Jack", map[interface{}]float64{"Dune": 4.0, "Ulysses": 2.0, "Emma": 2.0})
+	recs = books.RecommendForProfile(map[interface{}]float64{"Dune": 5.0}, 0, Normalize(NormalizeMinMax))
+	if len(recs) != 2 {
+		t.Fatal("Expected 2 recommendations, got", recs)
+	}
+	for _, r := range recs {
+		if r.Score != 1 {
+			t.Error("Expected equal scores to score 1, got", recs)
+		}
+	}
+}
+
+func TestNeighborsParallel(t *testing.T) {
+	table := benchmarkTable("neighborsparallel", 1000)
+	serial, _ := table.Neighbors(0)
+
+	for _, workers := range []int{0, 1, 4, 7, 2000} {
+		parallel, err := table.NeighborsParallel(0, workers)
+		if err != nil {
+			t.Fatal("Error retrieving neighbors", err)
+		}
+		if len(parallel) != len(serial) {
+			t.Fatal("Expected", len(serial), "neighbors, got", len(parallel))
+		}
+		for i := range serial {
+			if parallel[i] != serial[i] {
+				t.Fatal("Expected the order of Neighbors with", workers, "workers, got", parallel[i], "at", i)
+			}
+		}
+	}
+
+	if _, err := table.NeighborsParallel(-1, 4); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+// Compare to BenchmarkNeighbors.
+func BenchmarkNeighborsParallel(b *testing.B) {
+	table := benchmarkTable("benchneighbors", 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.NeighborsParallel(0, 4)
+	}
+}
+
+func TestIncludeRated(t *testing.T) {
+	books := Table("includerated")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0, "Emma": 4.0, "Dune": 2.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 5.0, "Emma": 5.0, "Dune": 1.0})
+
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 1 || recs[0].Rated {
+		t.Error("Expected rated data keys to be skipped by default, got", recs)
+	}
+
+	recs, _ = books.Recommend("Chris", 0, IncludeRated(), Normalize(NormalizeRatingScale))
+	if len(recs) != 3 {
+		t.Fatal("Expected 3 recommendations, got", recs)
+	}
+	for _, r := range recs {
+		switch r.Key {
+		case "Dune":
+			if r.Rated {
+				t.Error("Expected Dune not to be flagged as rated")
+			}
+		case "1984", "Emma":
+			rating := books.items["Chris"].Data()[r.Key]
+			if !r.Rated || r.Rating != rating {
+				t.Error("Expected", r.Key, "to carry the actual rating, got", r)
+			}
+		}
+	}
+
+	recs, _ = books.RecommendItemBased("Chris", 0, IncludeRated())
+	rated := 0
+	for _, r := range recs {
+		if r.Rated {
+			rated++
+			if r.Rating != books.items["Chris"].Data()[r.Key] {
+				t.Error("Expected", r.Key, "to carry the actual rating, got", r)
+			}
+		}
+	}
+	if rated == 0 {
+		t.Error("Expected item-based recommendations for rated data keys, got", recs)
+	}
+}
+
+func TestEngineTables(t *testing.T) {
+	e1 := NewEngine()
+	e2 := NewEngine()
+
+	books := e1.CreateTable("books", WithMetric(Jaccard))
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	if e1.Table("books") != books {
+		t.Error("Expected to get the created table back")
+	}
+	if e2.Table("books").Count() != 0 || Table("books") == books {
+		t.Error("Expected engines not to share tables")
+	}
+
+	e1.Table("authors")
+	names := e1.Tables()
+	if len(names) != 2 || names[0] != "authors" || names[1] != "books" {
+		t.Error("Expected sorted table names, got", names)
+	}
+	names[0] = "changed"
+	if e1.Tables()[0] != "authors" {
+		t.Error("Expected Tables to return a copy")
+	}
+
+	var out bytes.Buffer
+	if e1.CreateTable("books", WithLogger(StdLogger(log.New(&out, "", 0)))) != books {
+		t.Error("Expected existing table to be returned")
+	}
+	books.Flush()
+	if out.Len() == 0 {
+		t.Error("Expected options to be applied to the existing table")
+	}
+}
+
+func TestEngineConcurrentTable(t *testing.T) {
+	e := NewEngine()
+	tables := make(chan *RegommendTable, 20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tables <- e.Table("books")
+		}()
+	}
+	wg.Wait()
+	close(tables)
+
+	first := <-tables
+	for table := range tables {
+		if table != first {
+			t.Fatal("Expected all callers to get the same table")
+		}
+	}
+}
+
+func TestRecommendFilter(t *testing.T) {
+	books := Table("recommendfilter")
+	books.Add("Chris", map[interface{}]float64{"a": 1.0})
+	books.Add("Jay", map[interface{}]float64{"a": 1.0, "b": 4.0, "c": 3.0, "d": 0.5})
+
+	restricted := func(key interface{}, score float64) bool {
+		return key != "b"
+	}
+	recs, _ := books.Recommend("Chris", 2, Filter(restricted))
+	if len(recs) != 2 || recs[0].Key != "c" || recs[1].Key != "d" {
+		t.Error("Expected the next candidate to take b's place, got", recs)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic to be passed on")
+			}
+		}()
+		books.Recommend("Chris", 2, Filter(func(key interface{}, score float64) bool {
+			panic("filter failed")
+		}))
+	}()
+
+	// also when computing recommendations in several goroutines
+	func() {
+		defer func() {
+			if p := recover(); p != "batch filter failed" {
+				t.Error("Expected panic to be passed on by RecommendBatch, got", p)
+			}
+		}()
+		books.RecommendBatch([]interface{}{"Chris", "Jay"}, 2, Filter(func(key interface{}, score float64) bool {
+			panic("batch filter failed")
+		}))
+	}()
+
+	// the table is still usable after a panicking filter
+	books.Add("Mary", map[interface{}]float64{"a": 1.0, "e": 5.0})
+	recs, _ = books.Recommend("Chris", 1)
+	if len(recs) != 1 || recs[0].Key != "e" {
+		t.Error("Unexpected recommendations after panic", recs)
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	e := NewEngine()
+	books := e.CreateTable("books", WithTTL(time.Hour))
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	deleted := 0
+	books.SetAboutToDeleteItemCallback(func(item *RegommendItem) {
+		deleted++
+	})
+
+	if err := e.DropTable("books"); err != nil {
+		t.Fatal("Error dropping table", err)
+	}
+	if deleted != 2 {
+		t.Error("Expected delete callback to fire for 2 items, got", deleted)
+	}
+	if books.Count() != 0 || len(e.Tables()) != 0 {
+		t.Error("Expected table to be dropped")
+	}
+	if e.Table("books") == books {
+		t.Error("Expected a new table after dropping the old one")
+	}
+
+	if err := e.DropTable("authors"); err != ErrTableNotFound {
+		t.Error("Expected ErrTableNotFound, got", err)
+	}
+}
+
+func TestTableRegistry(t *testing.T) {
+	if Exists("registry") {
+		t.Fatal("Expected table not to exist yet")
+	}
+	books := Table("registry")
+	if !Exists("registry") {
+		t.Error("Expected table to exist after fetching it")
+	}
+	if Table("registry") != books {
+		t.Error("Expected the same table for the same name")
+	}
+	if Table("registry2") == books {
+		t.Error("Expected distinct tables for distinct names")
+	}
+}
+
+func TestDiversify(t *testing.T) {
+	shows := Table("diversify")
+	shows.Add("Chris", map[interface{}]float64{"x": 5.0, "y": 1.0})
+	shows.Add("Jay", map[interface{}]float64{"x": 5.0, "y": 1.0, "E1": 5.0, "E2": 5.0, "E3": 5.0, "Movie": 3.0})
+	shows.Add("Mary", map[interface{}]float64{"x": 4.0, "y": 1.0, "E1": 5.0, "E2": 5.0, "E3": 5.0, "Movie": 1.0})
+
+	recs, _ := shows.Recommend("Chris", 2)
+	if len(recs) != 2 || recs[0].Key != "E1" || recs[1].Key != "E2" {
+		t.Fatal("Expected two episodes without diversification, got", recs)
+	}
+	plain, _ := shows.Recommend("Chris", 2, Diversify(0))
+	if plain[0] != recs[0] || plain[1] != recs[1] {
+		t.Error("Expected lambda 0 not to change anything, got", plain)
+	}
+
+	recs, _ = shows.Recommend("Chris", 2, Diversify(1))
+	if len(recs) != 2 || recs[0].Key != "E1" || recs[1].Key != "Movie" {
+		t.Error("Expected the movie to replace the second episode, got", recs)
+	}
+
+	recs, _ = shows.Recommend("Chris", 0, Diversify(1))
+	if len(recs) != 4 || recs[1].Key != "Movie" {
+		t.Error("Expected all candidates to be re-ranked, got", recs)
+	}
+}
+
+func TestClone(t *testing.T) {
+	books := Table("clone")
+	books.SetMetric(Jaccard)
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 1.0, "Dune": 2.0})
+	books.Value("Chris")
+
+	clone := books.Clone("clone2")
+	if clone.name != "clone2" || clone.Count() != 2 {
+		t.Fatal("Expected a copy of all items, got", clone.Count())
+	}
+	p, _ := clone.Value("Chris")
+	if p == books.items["Chris"] || p.AccessCount() != 2 {
+		t.Error("Expected a copy of the item's state, got", p.AccessCount())
+	}
+
+	nbs, _ := clone.Neighbors("Chris")
+	if len(nbs) != 1 || math.Abs(nbs[0].Distance-1.0/3.0) > 1e-9 {
+		t.Error("Expected the clone to use the same metric, got", nbs)
+	}
+
+	clone.Update("Chris", map[interface{}]float64{"Dune": 3.0})
+	clone.Delete("Jay")
+	clone.SetMetric(Cosine)
+	if len(books.items["Chris"].Data()) != 2 || !books.Exists("Jay") {
+		t.Error("Expected changes to the clone not to affect the original")
+	}
+	books.Update("Chris", map[interface{}]float64{"Ulysses": 3.0})
+	if _, ok := clone.items["Chris"].Data()["Ulysses"]; ok {
+		t.Error("Expected changes to the original not to affect the clone")
+	}
+	clone.IncrementRating("Chris", "1984", 1.0)
+	clone.RateAt("Chris", "Emma", 2.0, time.Now())
+	if books.items["Chris"].Data()["1984"] != 5.0 || books.items["Chris"].Data()["Emma"] != 4.0 {
+		t.Error("Expected rating the clone not to affect the original, got", books.items["Chris"].Data())
+	}
+	if _, ok := books.items["Chris"].RatedOn("Emma"); ok {
+		t.Error("Expected timestamps of the clone not to leak into the original")
+	}
+	if Table("clone2") == clone {
+		t.Error("Expected clone not to be registered")
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	e := NewEngine()
+	for _, name := range []string{"books", "movies", "shows"} {
+		e.Table(name).Add("Chris", map[interface{}]float64{"a": 1.0})
+	}
+
+	names := e.Tables()
+	if len(names) != 3 || names[0] != "books" || names[1] != "movies" || names[2] != "shows" {
+		t.Fatal("Expected all 3 tables, got", names)
+	}
+
+	e.FlushAll()
+	for _, name := range names {
+		if e.Table(name).Count() != 0 {
+			t.Error("Expected table", name, "to be flushed")
+		}
+	}
+	if len(e.Tables()) != 3 {
+		t.Error("Expected tables to stay registered")
+	}
+
+	Table("flushall").Add("Chris", map[interface{}]float64{"a": 1.0})
+	found := false
+	for _, name := range Tables() {
+		found = found || name == "flushall"
+	}
+	if !found {
+		t.Error("Expected package-level Tables to list the table")
+	}
+}
+
+func TestPopularityFallback(t *testing.T) {
+	books := Table("popularityfallback")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0, "Dune": 2.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0, "Emma": 5.0, "Ulysses": 2.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 3.0, "Dune": 5.0})
+	books.SetPopularityFallback(1)
+
+	// kept up to date incrementally from now on
+	books.Add("Jack", map[interface{}]float64{"Ulysses": 1.0})
+	books.Update("Mary", map[interface{}]float64{"Ulysses": 3.0})
+	books.Delete("Jay")
+
+	books.Add("Tom", map[interface{}]float64{})
+	recs, _ := books.Recommend("Tom", 0)
+	if len(recs) != 4 {
+		t.Fatal("Expected 4 popular recommendations, got", recs)
+	}
+	expected := []interface{}{"1984", "Dune", "Ulysses", "Emma"}
+	for i, r := range recs {
+		if r.Key != expected[i] || !r.Fallback {
+			t.Error("Expected fallback recommendation", expected[i], "got", r)
+		}
+	}
+	if recs[0].Score != 4.0 || recs[2].Score != 2.0 {
+		t.Error("Expected average scores, got", recs)
+	}
+
+	recs, _ = books.Recommend("Chris", 0)
+	if len(recs) == 0 {
+		t.Fatal("Expected recommendations for rich profile")
+	}
+	for _, r := range recs {
+		if r.Fallback {
+			t.Error("Expected no fallback for rich profile, got", r)
+		}
+	}
+
+	books.SetPopularityFallback(0)
+	if recs, _ := books.Recommend("Tom", 0); len(recs) != 0 {
+		t.Error("Expected no recommendations without fallback, got", recs)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	shard1 := New("shard1")
+	shard1.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 2.0})
+	shard1.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	shard2 := New("shard2")
+	shard2.Add("Chris", map[interface{}]float64{"Emma": 3.0, "Dune": 4.0})
+	shard2.Add("Mary", map[interface{}]float64{"Dune": 1.0})
+
+	added := []interface{}{}
+	shard1.SetAddedItemCallback(func(item *RegommendItem) {
+		added = append(added, item.Key())
+	})
+	shard1.Merge(shard2)
+
+	if shard1.Count() != 3 {
+		t.Error("Expected 3 items after merging, got", shard1.Count())
+	}
+	data := shard1.items["Chris"].Data()
+	if len(data) != 3 || data["1984"] != 5.0 || data["Emma"] != 3.0 || data["Dune"] != 4.0 {
+		t.Error("Expected data of overlapping items to be merged, got", data)
+	}
+	if len(added) != 1 || added[0] != "Mary" {
+		t.Error("Expected added-item callback for Mary only, got", added)
+	}
+
+	// changes to the merged table don't leak into the other one
+	shard1.Update("Mary", map[interface{}]float64{"Dune": 5.0})
+	if shard2.items["Mary"].Data()["Dune"] != 1.0 || shard2.Count() != 2 {
+		t.Error("Expected the merged table to stay untouched")
+	}
+
+	// merging tables into each other concurrently doesn't deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			shard1.Merge(shard2)
+		}()
+		go func() {
+			defer wg.Done()
+			shard2.Merge(shard1)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConfidence(t *testing.T) {
+	books := Table("confidence")
+	books.SetAggregation(WeightedSum)
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0, "Dune": 4.0, "Ulysses": 1.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 2.0, "Dune": 4.0})
+
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 2 || recs[0].Key != "Dune" || recs[1].Key != "Ulysses" {
+		t.Fatal("Unexpected recommendations", recs)
+	}
+	if math.Abs(recs[0].Confidence-1.0) > 1e-9 {
+		t.Error("Expected full confidence for a data key all neighbors scored, got", recs[0].Confidence)
+	}
+	if recs[1].Confidence <= 0 || recs[1].Confidence >= 1 {
+		t.Error("Expected partial confidence, got", recs[1].Confidence)
+	}
+	if recs[0].Contributors != 2 || recs[1].Contributors != 1 {
+		t.Error("Expected 2 and 1 contributors, got", recs[0].Contributors, recs[1].Contributors)
+	}
+
+	recs, _ = books.Recommend("Chris", 0, MinScore(1.0))
+	if len(recs) != 1 || recs[0].Key != "Dune" {
+		t.Error("Expected the weak recommendation to be dropped, got", recs)
+	}
+
+	// no neighbor is similar at all
+	books.Add("Tom", map[interface{}]float64{"Moby-Dick": 5.0})
+	if recs, _ := books.Recommend("Tom", 0); len(recs) != 0 {
+		t.Error("Expected no recommendations without similar neighbors, got", recs)
+	}
+}
+
+func TestSignificanceCap(t *testing.T) {
+	books := Table("significancecap")
+	books.SetAggregation(WeightedSum)
+	chris := map[interface{}]float64{}
+	jay := map[interface{}]float64{"Dune": 4.0}
+	for i := 0; i < 30; i++ {
+		chris[i] = 5.0
+		jay[i] = 5.0
+	}
+	books.Add("Chris", chris)
+	books.Add("Jay", jay)
+	books.Add("Mary", map[interface{}]float64{0: 5.0, "Emma": 5.0})
+
+	scores := func(opts ...RecommendOption) map[interface{}]float64 {
+		recs, _ := books.Recommend("Chris", 0, opts...)
+		m := map[interface{}]float64{}
+		for _, r := range recs {
+			m[r.Key] = r.Raw
+		}
+		return m
+	}
+	plain := scores()
+	capped := scores(SignificanceCap(30))
+	if plain["Dune"] == 0 || plain["Emma"] == 0 {
+		t.Fatal("Expected both neighbors to contribute, got", plain)
+	}
+
+	// Jay shares all 30 keys and counts fully, Mary shares just one
+	if math.Abs(capped["Dune"]-plain["Dune"]) > 1e-9 {
+		t.Error("Expected the full-overlap neighbor to keep its weight, got", capped["Dune"], plain["Dune"])
+	}
+	if math.Abs(capped["Emma"]-plain["Emma"]/30) > 1e-9 {
+		t.Error("Expected the single-overlap neighbor to count 1/30, got", capped["Emma"], plain["Emma"])
+	}
+	if capped["Emma"]/capped["Dune"] >= plain["Emma"]/plain["Dune"] {
+		t.Error("Expected the single-overlap neighbor's influence to drop")
+	}
+}
+
+func TestRange(t *testing.T) {
+	table := Table("range")
+	for i := 0; i < 10; i++ {
+		table.Add(i, map[interface{}]float64{"a": float64(i)})
+	}
+
+	seen := map[interface{}]bool{}
+	table.Range(func(key interface{}, item *RegommendItem) bool {
+		if item.Key() != key {
+			t.Error("Expected item to match its key, got", item.Key(), key)
+		}
+		seen[key] = true
+		return true
+	})
+	if len(seen) != 10 {
+		t.Error("Expected to visit 10 items, got", len(seen))
+	}
+
+	// stops early and may call back into the table
+	visited := 0
+	table.Range(func(key interface{}, item *RegommendItem) bool {
+		visited++
+		table.Delete(key)
+		return visited < 3
+	})
+	if visited != 3 || table.Count() != 7 {
+		t.Error("Expected to stop after 3 items, got", visited, table.Count())
+	}
+}
+
+func TestRecommendPredictedScores(t *testing.T) {
+	books := Table("predictedscores")
+	// a neighbor's similarity is a tenth of its score for "a"
+	books.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return t2["a"] / 10
+	})
+	books.Add("Chris", map[interface{}]float64{"a": 10.0})
+	books.Add("Jay", map[interface{}]float64{"a": 9.0, "x": 4.0, "y": 2.0})
+	books.Add("Mary", map[interface{}]float64{"a": 6.0, "x": 2.0})
+	books.Add("Jack", map[interface{}]float64{"a": 3.0, "y": 5.0, "z": 1.0})
+	books.Add("Tom", map[interface{}]float64{"a": 0.0, "w": 5.0})
+
+	recs, _ := books.Recommend("Chris", 0)
+	// x: (0.9 * 4 + 0.6 * 2) / (0.9 + 0.6) = 3.2
+	// y: (0.9 * 2 + 0.3 * 5) / (0.9 + 0.3) = 2.75
+	// z: (0.3 * 1) / 0.3 = 1
+	// w: only scored by Tom, who isn't similar at all
+	expected := []struct {
+		key   string
+		score float64
+	}{{"x", 3.2}, {"y", 2.75}, {"z", 1.0}}
+	if len(recs) != len(expected) {
+		t.Fatal("Expected", len(expected), "recommendations, got", recs)
+	}
+	for i, e := range expected {
+		if recs[i].Key != e.key || math.Abs(recs[i].Score-e.score) > 1e-9 {
+			t.Error("Expected", e.key, "with score", e.score, "got", recs[i])
+		}
+	}
+
+	// x: (0.9 + 0.6) / (0.9 + 0.6 + 0.3), from 2 neighbors
+	if math.Abs(recs[0].Confidence-1.5/1.8) > 1e-9 || recs[0].Contributors != 2 {
+		t.Error("Expected confidence 1.5 / 1.8 from 2 contributors, got", recs[0])
+	}
+	// z: 0.3 / (0.9 + 0.6 + 0.3), from Jack only
+	if math.Abs(recs[2].Confidence-0.3/1.8) > 1e-9 || recs[2].Contributors != 1 {
+		t.Error("Expected confidence 0.3 / 1.8 from 1 contributor, got", recs[2])
+	}
+}
+
+func TestTableFilter(t *testing.T) {
+	books := Table("tablefilter")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 2.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 3.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 4.5})
+	books.Add("Jack", map[interface{}]float64{"Emma": 5.0})
+
+	items := books.Filter(func(key interface{}, item *RegommendItem) bool {
+		// may call back into the table
+		books.Count()
+		return item.Data()["1984"] > 4.0
+	})
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, item.Key().(string))
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "Chris" || keys[1] != "Mary" {
+		t.Error("Expected Chris and Mary to rate 1984 above 4, got", keys)
+	}
+
+	if items := books.Filter(func(key interface{}, item *RegommendItem) bool { return false }); len(items) != 0 {
+		t.Error("Expected no matches, got", items)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	books := Table("decay")
+	now := time.Now()
+	books.Add("Chris", map[interface{}]float64{"a": 5.0, "b": 5.0})
+	books.Add("Mary", map[interface{}]float64{"a": 3.0, "b": 5.0, "c": 2.0})
+	books.RateAt("Jay", "a", 5.0, now.Add(-2*time.Hour))
+	books.RateAt("Jay", "b", 5.0, now)
+	books.RateAt("Jay", "d", 4.0, now.Add(-2*time.Hour))
+
+	if at, ok := books.items["Jay"].RatedOn("a"); !ok || !at.Equal(now.Add(-2*time.Hour)) {
+		t.Error("Expected timestamp to be stored, got", at, ok)
+	}
+	if _, ok := books.items["Chris"].RatedOn("a"); ok {
+		t.Error("Expected no timestamp for plain scores")
+	}
+
+	// without decay, Jay's scores match Chris' perfectly
+	nbs, _ := books.Neighbors("Chris")
+	if nbs[0].Key != "Jay" || math.Abs(nbs[0].Distance-1.0) > 1e-9 {
+		t.Fatal("Expected Jay to be the closest neighbor, got", nbs)
+	}
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 2 || recs[0].Key != "d" || recs[0].Score != 4.0 {
+		t.Fatal("Unexpected recommendations", recs)
+	}
+
+	// Jay's score for a is two half-lives old now, so Mary is closer
+	books.SetDecay(time.Hour)
+	nbs, _ = books.Neighbors("Chris")
+	if nbs[0].Key != "Mary" || nbs[1].Key != "Jay" {
+		t.Error("Expected Jay to drop behind Mary, got", nbs)
+	}
+	recs, _ = books.Recommend("Chris", 0)
+	if len(recs) != 2 || recs[1].Key != "d" || math.Abs(recs[1].Score-4.0*math.Exp(-2)) > 1e-3 {
+		t.Error("Expected Jay's old score for d to decay, got", recs)
+	}
+
+	// a new score replaces the timestamp
+	books.Update("Jay", map[interface{}]float64{"a": 5.0})
+	if _, ok := books.items["Jay"].RatedOn("a"); ok {
+		t.Error("Expected updated score to lose its timestamp")
+	}
+	nbs, _ = books.Neighbors("Chris")
+	if nbs[0].Key != "Jay" {
+		t.Error("Expected Jay to be the closest neighbor again, got", nbs)
+	}
+
+	if err := books.RateAt("Jay", "a", math.NaN(), now); err == nil {
+		t.Error("Expected error for invalid rating")
+	}
+}
+
+func TestNegativeFeedback(t *testing.T) {
+	books := Table("negativefeedback")
+	books.Add("Chris", map[interface{}]float64{"a": 5.0, "b": -4.0})
+	books.Add("Jay", map[interface{}]float64{"a": 5.0, "b": 5.0, "c": -5.0})
+	books.Add("Mary", map[interface{}]float64{"a": 4.0, "c": 2.0, "d": 4.0})
+	books.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return 1.0
+	})
+
+	// Jay's dislike drags c below zero
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 2 || recs[1].Key != "c" || math.Abs(recs[1].Score+1.5) > 1e-9 {
+		t.Fatal("Expected c to score -1.5, got", recs)
+	}
+	recs, _ = books.Recommend("Chris", 0, ExcludeNegative())
+	if len(recs) != 1 || recs[0].Key != "d" {
+		t.Error("Expected c to be excluded, got", recs)
+	}
+
+	recs, _ = books.Recommend("Chris", 0, IncludeRated())
+	if len(recs) != 4 {
+		t.Fatal("Expected 4 recommendations including rated ones, got", recs)
+	}
+	recs, _ = books.Recommend("Chris", 0, IncludeRated(), VetoDisliked())
+	for _, r := range recs {
+		if r.Key == "b" {
+			t.Error("Expected b to be vetoed, got", recs)
+		}
+	}
+	if len(recs) != 3 {
+		t.Error("Expected 3 recommendations, got", recs)
+	}
+}
+
+func TestValues(t *testing.T) {
+	books := Table("values")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+
+	items := books.Values()
+	if len(items) != 2 {
+		t.Fatal("Expected 2 items, got", len(items))
+	}
+	sum := 0.0
+	for _, item := range items {
+		sum += item.Data()["1984"]
+	}
+	if sum != 9.0 {
+		t.Error("Expected a sum of 9, got", sum)
+	}
+
+	// a snapshot, unaffected by later changes
+	books.Delete("Jay")
+	if len(items) != 2 || len(books.Values()) != 1 {
+		t.Error("Expected the snapshot to keep both items")
+	}
+}
+
+func TestPredictScore(t *testing.T) {
+	books := Table("predictscore")
+	books.SetSimilarityFunc(func(t1, t2 map[interface{}]float64) float64 {
+		return t2["a"] / 10
+	})
+	books.Add("Chris", map[interface{}]float64{"a": 10.0})
+	books.Add("Jay", map[interface{}]float64{"a": 9.0, "x": 4.0})
+	books.Add("Mary", map[interface{}]float64{"a": 6.0, "x": 2.0})
+	books.Add("Tom", map[interface{}]float64{"a": 0.0, "w": 5.0})
+
+	// (0.9 * 4 + 0.6 * 2) / (0.9 + 0.6)
+	score, err := books.PredictScore("Chris", "x")
+	if err != nil || math.Abs(score-3.2) > 1e-9 {
+		t.Error("Expected a predicted score of 3.2, got", score, err)
+	}
+	recs, _ := books.Recommend("Chris", 1)
+	if recs[0].Key != "x" || math.Abs(recs[0].Score-score) > 1e-9 {
+		t.Error("Expected prediction to match the recommendation, got", recs)
+	}
+
+	if _, err := books.PredictScore("Chris", "w"); err != ErrNotEnoughData {
+		t.Error("Expected ErrNotEnoughData without similar neighbors, got", err)
+	}
+	if _, err := books.PredictScore("Chris", "y"); err != ErrNotEnoughData {
+		t.Error("Expected ErrNotEnoughData for a data key nobody scored, got", err)
+	}
+	if _, err := books.PredictScore("Jack", "x"); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+
+	count := books.items["Chris"].AccessCount()
+	books.PredictScore("Chris", "x")
+	if books.items["Chris"].AccessCount() != count {
+		t.Error("Expected prediction not to count as an access")
+	}
+}
+
+func TestSimilarItems(t *testing.T) {
+	ratings := Table("similaritems")
+	ratings.Add("u1", map[interface{}]float64{"i1": 5.0, "i2": 5.0, "i3": 1.0})
+	ratings.Add("u2", map[interface{}]float64{"i1": 1.0, "i2": 1.0, "i3": 5.0})
+	ratings.Add("u3", map[interface{}]float64{"i1": 4.0, "i2": 4.0})
+	ratings.Add("u4", map[interface{}]float64{"i4": 3.0})
+
+	items, err := ratings.SimilarItems("i1", 0)
+	if err != nil {
+		t.Fatal("Error retrieving similar items", err)
+	}
+	// i4 was never scored along with i1
+	if len(items) != 2 || items[0].Key != "i2" || items[1].Key != "i3" {
+		t.Fatal("Expected i2 and i3, got", items)
+	}
+	if math.Abs(items[0].Distance-1.0) > 1e-9 {
+		t.Error("Expected i2 to be scored just like i1, got", items[0].Distance)
+	}
+
+	items[0].Key = "changed"
+	if items, _ := ratings.SimilarItems("i1", 1); len(items) != 1 || items[0].Key != "i2" {
+		t.Error("Expected the top similar item to be i2, got", items)
+	}
+
+	ratings.SetMetric(Jaccard)
+	items, _ = ratings.SimilarItems("i1", 0)
+	if len(items) != 2 || items[1].Key != "i3" || math.Abs(items[1].Distance-2.0/3.0) > 1e-9 {
+		t.Error("Expected the configured metric to be used, got", items)
+	}
+
+	if _, err := ratings.SimilarItems("i5", 0); err == nil {
+		t.Error("Expected error for unknown data key")
+	}
+}
+
+func TestMergeWith(t *testing.T) {
+	newShards := func() (*RegommendTable, *RegommendTable) {
+		shard1 := New("mergewith1")
+		shard1.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 2.0})
+		shard2 := New("mergewith2")
+		shard2.Add("Chris", map[interface{}]float64{"Emma": 3.0, "Dune": 4.0})
+		shard2.Add("Mary", map[interface{}]float64{"Dune": 1.0})
+		return shard1, shard2
+	}
+
+	// inserting items missing in the table
+	shard1, shard2 := newShards()
+	shard1.MergeWith(shard2, MergeOverwrite)
+	if shard1.Count() != 2 || shard1.items["Mary"].Data()["Dune"] != 1.0 {
+		t.Error("Expected Mary to be inserted, got", shard1.Count())
+	}
+	data := shard1.items["Chris"].Data()
+	if len(data) != 2 || data["Emma"] != 3.0 || data["Dune"] != 4.0 {
+		t.Error("Expected incoming data to overwrite the existing one, got", data)
+	}
+
+	shard1, shard2 = newShards()
+	shard1.MergeWith(shard2, MergeSum)
+	data = shard1.items["Chris"].Data()
+	if len(data) != 3 || data["1984"] != 5.0 || data["Emma"] != 5.0 || data["Dune"] != 4.0 {
+		t.Error("Expected conflicting scores to be summed up, got", data)
+	}
+	if shard2.items["Chris"].Data()["Emma"] != 3.0 {
+		t.Error("Expected the merged table to stay untouched")
+	}
+
+	shard1, shard2 = newShards()
+	shard1.MergeWith(shard2, func(existing, incoming map[interface{}]float64) map[interface{}]float64 {
+		return map[interface{}]float64{"resolved": float64(len(existing) + len(incoming))}
+	})
+	data = shard1.items["Chris"].Data()
+	if len(data) != 1 || data["resolved"] != 4.0 {
+		t.Error("Expected custom resolver to be used, got", data)
+	}
+	nbs, _ := shard1.Neighbors("Mary")
+	if len(nbs) != 1 || nbs[0].Distance != 0 {
+		t.Error("Expected resolved data to be used for similarities, got", nbs)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	books := Table("metadata")
+	chris := books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0, "Dune": 4.0, "Ulysses": 3.0})
+	chris.SetMeta("segment", "scifi")
+
+	if v, ok := chris.Meta("segment"); !ok || v != "scifi" {
+		t.Error("Expected metadata to be stored, got", v, ok)
+	}
+	if _, ok := chris.Meta("signup"); ok {
+		t.Error("Expected missing metadata not to be found")
+	}
+
+	// filters can read the metadata of the item recommendations are made for
+	recs, _ := books.Recommend("Chris", 0, FilterWithItem(func(item *RegommendItem, key interface{}, score float64) bool {
+		segment, _ := item.Meta("segment")
+		return segment != "scifi" || key == "Dune"
+	}))
+	if len(recs) != 1 || recs[0].Key != "Dune" {
+		t.Error("Expected only Dune for the scifi segment, got", recs)
+	}
+
+	// concurrent changes to metadata don't race with recommendations
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			chris.SetMeta("count", i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			books.Recommend("Chris", 0, FilterWithItem(func(item *RegommendItem, key interface{}, score float64) bool {
+				_, ok := item.Meta("count")
+				return ok
+			}))
+		}
+	}()
+	wg.Wait()
+	chris.SetMeta("count", nil)
+
+	// carried over by callbacks when deleting and adding an item again
+	var meta map[string]interface{}
+	books.SetAboutToDeleteItemCallback(func(item *RegommendItem) {
+		meta = item.Metadata()
+	})
+	books.SetAddedItemCallback(func(item *RegommendItem) {
+		for k, v := range meta {
+			item.SetMeta(k, v)
+		}
+	})
+	books.Delete("Chris")
+	chris = books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	if v, _ := chris.Meta("segment"); v != "scifi" || len(chris.Metadata()) != 1 {
+		t.Error("Expected metadata to survive deleting and adding, got", chris.Metadata())
+	}
+	books.SetAboutToDeleteItemCallback(nil)
+	books.SetAddedItemCallback(nil)
+
+	// serialized along with the items
+	b, err := books.MarshalJSON()
+	if err != nil {
+		t.Fatal("Error encoding JSON", err)
+	}
+	fromJSON := New("")
+	fromJSON.UnmarshalJSON(b)
+	if v, _ := fromJSON.items["Chris"].Meta("segment"); v != "scifi" {
+		t.Error("Expected metadata to be stored as JSON, got", v)
+	}
+	b, err = books.GobEncode()
+	if err != nil {
+		t.Fatal("Error encoding gob", err)
+	}
+	fromGob := New("")
+	fromGob.GobDecode(b)
+	if v, _ := fromGob.items["Chris"].Meta("segment"); v != "scifi" || fromGob.items["Jay"].Metadata() != nil {
+		t.Error("Expected metadata to be stored as gob, got", v)
+	}
+	if v, _ := books.Clone("metadataclone").items["Chris"].Meta("segment"); v != "scifi" {
+		t.Error("Expected metadata to be cloned, got", v)
+	}
+}
+
+func TestDeleteConcurrently(t *testing.T) {
+	books := Table("deleteconcurrently")
+	books.SetPopularityFallback(1)
+	var mutex sync.Mutex
+	announced := map[*RegommendItem]bool{}
+	books.SetAboutToDeleteItemCallback(func(item *RegommendItem) {
+		mutex.Lock()
+		announced[item] = true
+		mutex.Unlock()
+		// let others change the item meanwhile
+		time.Sleep(time.Microsecond)
+	})
+
+	var wg sync.WaitGroup
+	removed := make(chan *RegommendItem, 400)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				books.Add("Chris", map[interface{}]float64{"1984": float64(i*100 + j)})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if item, err := books.Delete("Chris"); err == nil {
+					removed <- item
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(removed)
+
+	// every removed item was announced to the callback before
+	for item := range removed {
+		if !announced[item] {
+			t.Error("Expected callback for deleted item", item.Data())
+		}
+	}
+
+	// popularity stays consistent with the remaining items
+	books.Delete("Chris")
+	if len(books.popularity) != 0 {
+		t.Error("Expected no popularity left, got", books.popularity)
+	}
+}
+
+func TestExpiredNeighbors(t *testing.T) {
+	books := New("expiredneighbors")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.AddWithTTL("Mary", map[interface{}]float64{"1984": 5.0, "Dune": 4.0}, 10*time.Millisecond)
+	// keep Mary around, expired but not yet removed
+	books.StopTTL()
+	time.Sleep(20 * time.Millisecond)
+
+	if books.Count() != 3 {
+		t.Error("Expected Mary not to be removed, count is", books.Count())
+	}
+	nbs, _ := books.Neighbors("Chris")
+	if len(nbs) != 1 || nbs[0].Key != "Jay" {
+		t.Error("Expected expired Mary not to be a neighbor, got", nbs)
+	}
+	recs, _ := books.Recommend("Chris", 0)
+	if len(recs) != 0 {
+		t.Error("Expected no recommendations from expired Mary, got", recs)
+	}
+}
+
+func TestFlushStopsExpiration(t *testing.T) {
+	books := New("flushexpiration")
+	books.AddWithTTL("Chris", map[interface{}]float64{"1984": 5.0}, time.Hour)
+	books.Flush()
+
+	books.RLock()
+	stopped := books.ttlStop == nil
+	books.RUnlock()
+	if !stopped {
+		t.Error("Expected flush to stop the expiration loop")
+	}
+
+	expired := make(chan interface{}, 1)
+	books.SetExpiredItemCallback(func(item *RegommendItem) {
+		expired <- item.Key()
+	})
+	books.AddWithTTL("Jay", map[interface{}]float64{"1984": 4.0}, 10*time.Millisecond)
+	defer books.StopTTL()
+	select {
+	case key := <-expired:
+		if key != "Jay" {
+			t.Error("Expected expired item to be Jay, got", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected expiration to restart after flush")
+	}
+}
+
+func TestRegisterExpvars(t *testing.T) {
+	books := New("expvars")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	if err := books.RegisterExpvars("regommend.test"); err != nil {
+		t.Fatal("Error registering expvars:", err)
+	}
+	if err := books.RegisterExpvars("regommend.test"); err == nil {
+		t.Error("Expected error registering the same namespace twice")
+	}
+
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0, "Dune": 5.0})
+	books.Add("Mary", map[interface{}]float64{"Emma": 3.0})
+	books.Delete("Mary")
+	books.AddOrUpdate("Tom", map[interface{}]float64{"Dune": 3.0})
+	books.AddOrUpdate("Tom", map[interface{}]float64{"Emma": 2.0})
+	books.IncrementRating("Ann", "Dune", 1.0)
+	books.Recommend("Chris", 0)
+
+	if v := expvar.Get("regommend.test.items").String(); v != "4" {
+		t.Error("Expected 4 items, got", v)
+	}
+	ops := expvar.Get("regommend.test.ops").(*expvar.Map)
+	for op, n := range map[string]string{"add": "4", "delete": "1", "recommend": "1", "value": "1"} {
+		if v := ops.Get(op); v == nil || v.String() != n {
+			t.Errorf("Expected %s count of %s, got %v", op, n, v)
+		}
+	}
+	if v := expvar.Get("regommend.test.similarity_seconds").String(); v == "0" {
+		t.Error("Expected similarity time to be recorded, got", v)
+	}
+}
+
+func TestRegisterExpvarsConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- New(fmt.Sprintf("expvars%d", i)).RegisterExpvars("regommend.concurrent")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	registered := 0
+	for err := range errs {
+		if err == nil {
+			registered++
+		}
+	}
+	if registered != 1 {
+		t.Error("Expected exactly one table to register, got", registered)
+	}
+}
+
+func TestAddedItemFilter(t *testing.T) {
+	books := New("addeditemfilter")
+	added := 0
+	books.SetAddedItemCallback(func(item *RegommendItem) {
+		added++
+	})
+	books.SetAddedItemFilter(func(item *RegommendItem) bool {
+		return len(item.Data()) > 1
+	})
+
+	if item := books.Add("Chris", map[interface{}]float64{"1984": 5.0}); item != nil {
+		t.Error("Expected rejected item not to be returned, got", item)
+	}
+	if books.Count() != 0 || added != 0 {
+		t.Error("Expected rejected item not to be added, count is", books.Count())
+	}
+
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	if books.Count() != 1 || added != 1 {
+		t.Error("Expected accepted item to be added, count is", books.Count())
+	}
+
+	books.SetDataLoader(func(key interface{}) *RegommendItem {
+		item := CreateRegommendItem(key, map[interface{}]float64{"Dune": 3.0})
+		return &item
+	})
+	if _, err := books.Value("Mary"); err == nil || books.Count() != 1 {
+		t.Error("Expected rejected item not to be loaded, count is", books.Count())
+	}
+
+	if item := books.AddOrUpdate("Tom", map[interface{}]float64{"1984": 5.0}); item != nil {
+		t.Error("Expected AddOrUpdate to return nil for a rejected item, got", item)
+	}
+	if err := books.IncrementRating("Tom", "1984", 1.0); err != ErrAddCanceled {
+		t.Error("Expected IncrementRating to return ErrAddCanceled, got", err)
+	}
+	if err := books.RateAt("Tom", "1984", 5.0, time.Now()); err != ErrAddCanceled {
+		t.Error("Expected RateAt to return ErrAddCanceled, got", err)
+	}
+	other := New("addeditemfilter2")
+	other.Add("Tom", map[interface{}]float64{"1984": 5.0})
+	other.Add("Ann", map[interface{}]float64{"1984": 5.0, "Dune": 4.0})
+	books.Merge(other)
+	if books.Count() != 2 || books.Exists("Tom") || added != 2 {
+		t.Error("Expected only Ann to be merged, count is", books.Count())
+	}
+
+	// updates of existing items don't get filtered
+	if item := books.AddOrUpdate("Jay", map[interface{}]float64{"Dune": 1.0}); item == nil {
+		t.Error("Expected AddOrUpdate to update Jay")
+	}
+	if err := books.IncrementRating("Jay", "Dune", 1.0); err != nil {
+		t.Error("Error incrementing Jay's rating:", err)
+	}
+	if books.Count() != 2 || added != 2 {
+		t.Error("Expected count to stay unchanged, got", books.Count())
+	}
+}
+
+func TestAboutToDeleteFilter(t *testing.T) {
+	books := New("abouttodeletefilter")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	deleted := 0
+	books.SetAboutToDeleteItemCallback(func(item *RegommendItem) {
+		deleted++
+	})
+	books.SetAboutToDeleteFilter(func(item *RegommendItem) bool {
+		return item.Key() != "Chris"
+	})
+
+	if _, err := books.Delete("Chris"); err != ErrDeleteCanceled {
+		t.Error("Expected ErrDeleteCanceled, got", err)
+	}
+	if books.Count() != 2 || deleted != 0 {
+		t.Error("Expected deletion to be canceled, count is", books.Count())
+	}
+
+	if _, err := books.Delete("Jay"); err != nil {
+		t.Error("Error deleting Jay:", err)
+	}
+	if books.Count() != 1 || deleted != 1 {
+		t.Error("Expected Jay to be deleted, count is", books.Count())
+	}
+}
+
+func TestMostAccessed(t *testing.T) {
+	books := New("mostaccessed")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 4.0})
+	books.Add("Mary", map[interface{}]float64{"Emma": 3.0})
+	for i := 0; i < 3; i++ {
+		books.Value("Jay")
+	}
+	books.Recommend("Mary", 0)
+
+	items := books.MostAccessed(2)
+	if len(items) != 2 || items[0].Key() != "Jay" || items[1].Key() != "Mary" {
+		t.Error("Expected Jay and Mary to be accessed most, got", items)
+	}
+	if all := books.MostAccessed(0); len(all) != 3 || all[2].Key() != "Chris" {
+		t.Error("Expected all items, got", all)
+	}
+
+	jay := items[0]
+	books.Delete("Jay")
+	if jay.KeepAlive(); jay.AccessCount() != 0 {
+		t.Error("Expected Delete to drop the access count, got", jay.AccessCount())
+	}
+	mary := items[1]
+	books.Flush()
+	if mary.AccessCount() != 0 {
+		t.Error("Expected Flush to reset the access count, got", mary.AccessCount())
+	}
+}
+
+func TestAccessedOnConcurrently(t *testing.T) {
+	books := New("accessedonconcurrently")
+	item := books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			books.Update("Chris", map[interface{}]float64{"Emma": float64(i)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			books.IncrementRating("Chris", "1984", 1.0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			item.AccessedOn()
+			books.Value("Chris")
+		}
+	}()
+	wg.Wait()
+
+	if item.AccessedOn().Before(item.CreatedOn()) {
+		t.Error("Expected access time not to precede creation time")
+	}
+}
+
+func TestCloneExpires(t *testing.T) {
+	books := New("cloneexpires")
+	defer books.StopTTL()
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0})
+	books.AddWithTTL("Jay", map[interface{}]float64{"1984": 4.0}, 20*time.Millisecond)
+
+	clone := books.Clone("cloneexpires2")
+	defer clone.StopTTL()
+	expired := make(chan interface{}, 1)
+	clone.SetExpiredItemCallback(func(item *RegommendItem) {
+		expired <- item.Key()
+	})
+
+	select {
+	case key := <-expired:
+		if key != "Jay" {
+			t.Error("Expected expired item to be Jay, got", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Jay to expire from the clone")
+	}
+	if clone.Count() != 1 || !clone.Exists("Chris") {
+		t.Error("Expected Chris to remain in the clone, count is", clone.Count())
+	}
+}
+
+func TestNormalizeRatingScaleOnScale(t *testing.T) {
+	books := New("normalizeratingscale")
+	books.Add("Chris", map[interface{}]float64{"1984": 5.0, "Emma": 4.0})
+	books.Add("Jay", map[interface{}]float64{"1984": 5.0, "Emma": 4.0, "Popular": 3.0, "Niche": 5.0})
+	books.Add("Mary", map[interface{}]float64{"1984": 4.0, "Emma": 4.0, "Popular": 3.0})
+
+	// WeightedAverage and item-based scores are on the rating scale already
+	raw, _ := books.Recommend("Chris", 0)
+	recs, _ := books.Recommend("Chris", 0, Normalize(NormalizeRatingScale))
+	if len(recs) != len(raw) || len(recs) == 0 {
+		t.Fatal("Expected the same recommendations, got", recs, raw)
+	}
+	for i := range recs {
+		if recs[i].Score != raw[i].Score || recs[i].Raw != raw[i].Score {
+			t.Error("Expected averaged scores to stay the same, got", recs[i], raw[i])
+		}
+	}
+
+	raw, _ = books.RecommendItemBased("Chris", 0)
+	recs, _ = books.RecommendItemBased("Chris", 0, Normalize(NormalizeRatingScale))
+	if len(recs) != len(raw) || len(recs) == 0 {
+		t.Fatal("Expected the same item-based recommendations, got", recs, raw)
+	}
+	for i := range recs {
+		if recs[i] != raw[i] {
+			t.Error("Expected item-based scores to stay the same, got", recs[i], raw[i])
+		}
+	}
+}
+
+func TestIncrementRatingKeepsSnapshots(t *testing.T) {
+	books := New("incrementsnapshots")
+	books.IncrementRating("Chris", "1984", 1.0)
+	books.IncrementRating("Chris", "1984", 1.0)
+
+	item, _ := books.Value("Chris")
+	snapshot := item.Data()
+	books.IncrementRating("Chris", "1984", 1.0)
+	books.IncrementRating("Chris", "Emma", 1.0)
+	if len(snapshot) != 1 || snapshot["1984"] != 2.0 {
+		t.Error("Expected data returned earlier to stay untouched, got", snapshot)
+	}
+	if data := item.Data(); len(data) != 2 || data["1984"] != 3.0 || data["Emma"] != 1.0 {
+		t.Error("Expected incremented scores, got", data)
+	}
+
+	// the caller's map isn't modified either
+	data := map[interface{}]float64{"1984": 5.0}
+	books.Add("Jay", data)
+	books.IncrementRating("Jay", "1984", 1.0)
+	if data["1984"] != 5.0 {
+		t.Error("Expected the added map to stay untouched, got", data)
+	}
+}
+
+func BenchmarkIncrementRating(b *testing.B) {
+	books := New("benchmarkincrement")
+	data := make(map[interface{}]float64)
+	for i := 0; i < 1000; i++ {
+		data[i] = 1.0
+	}
+	books.Add("Chris", data)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		books.IncrementRating("Chris", i%1000, 1.0)
+	}
+}
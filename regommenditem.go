@@ -9,28 +9,202 @@ package regommend
 
 import (
 	"sync"
-	_ "time"
+	"sync/atomic"
+	"time"
 )
 
 // Structure of an item in the recommendation engine.
 // Parameter data contains the user-set value in the engine.
 type RegommendItem struct {
+	// How often the item was accessed, accessed atomically, negative once
+	// the item got removed from its table. Comes first to be 64-bit
+	// aligned on 32-bit platforms.
+	accessCount int64
+
 	sync.RWMutex
 
 	// The item's key.
 	key interface{}
 	// All items for this key.
 	data map[interface{}]float64
+	// Set once data may be referenced outside the item, e.g. after Data
+	// returned it, accessed atomically. Until then, increment modifies
+	// data in place instead of replacing it.
+	shared int32
+	// When scores were given, for those given by RateAt. Replaced rather
+	// than modified, just like data.
+	ratedOn map[interface{}]time.Time
+
+	// Creation time, immutable.
+	createdOn time.Time
+	// Last access time, guarded by its own mutex so accessing the item
+	// doesn't wait for its data.
+	accessedOn  time.Time
+	accessMutex sync.RWMutex
+	// How long the item lives without being accessed, forever if zero.
+	lifeSpan time.Duration
+
+	// The cached L2 norm of data, valid if hasNorm is set.
+	norm    float64
+	hasNorm bool
+
+	// Arbitrary attributes of the item, guarded by their own mutex so they
+	// can be accessed while the table is busy with the item's data.
+	meta      map[string]interface{}
+	metaMutex sync.RWMutex
 }
 
 // Returns a newly created RegommendItem.
 // Parameter key is the item's key.
 // Parameter data is the item's value.
 func CreateRegommendItem(key interface{}, data map[interface{}]float64) RegommendItem {
+	t := time.Now()
 	return RegommendItem{
-		key:           key,
-		data:          data,
+		key:        key,
+		data:       data,
+		shared:     1,
+		createdOn:  t,
+		accessedOn: t,
+	}
+}
+
+// Marks the item as accessed, updating its access time and count. Keeps
+// the item from expiring for another life span, see AddWithTTL. Value does
+// this implicitly, just like Recommend for the item recommendations are
+// made for.
+func (item *RegommendItem) KeepAlive() {
+	for {
+		n := atomic.LoadInt64(&item.accessCount)
+		if n < 0 {
+			// removed, nothing to count for
+			break
+		}
+		if atomic.CompareAndSwapInt64(&item.accessCount, n, n+1) {
+			break
+		}
+	}
+	item.touch()
+}
+
+// Resets the item's access count once it got removed from its table, so
+// accessing it afterwards doesn't count anymore.
+func (item *RegommendItem) resetAccess() {
+	atomic.StoreInt64(&item.accessCount, -1)
+}
+
+// Updates the item's access time without counting an access, for changes
+// to its data.
+func (item *RegommendItem) touch() {
+	item.accessMutex.Lock()
+	defer item.accessMutex.Unlock()
+	item.accessedOn = time.Now()
+}
+
+// Returns when this item was created.
+func (item *RegommendItem) CreatedOn() time.Time {
+	// immutable
+	return item.createdOn
+}
+
+// Returns when this item was last accessed, see KeepAlive.
+func (item *RegommendItem) AccessedOn() time.Time {
+	item.accessMutex.RLock()
+	defer item.accessMutex.RUnlock()
+	return item.accessedOn
+}
+
+// Returns how often this item was accessed, see KeepAlive. Deleting,
+// replacing or flushing the item resets the count to zero for good.
+func (item *RegommendItem) AccessCount() int64 {
+	if n := atomic.LoadInt64(&item.accessCount); n > 0 {
+		return n
 	}
+
+	return 0
+}
+
+// Returns how long this item lives without being accessed, zero if it
+// only expires due to its table's TTL, see AddWithTTL.
+func (item *RegommendItem) LifeSpan() time.Duration {
+	// immutable
+	return item.lifeSpan
+}
+
+// Returns a copy of this item with its own copy of the data.
+func (item *RegommendItem) clone() *RegommendItem {
+	item.RLock()
+	defer item.RUnlock()
+
+	data := make(map[interface{}]float64, len(item.data))
+	for k, v := range item.data {
+		data[k] = v
+	}
+	item.accessMutex.RLock()
+	defer item.accessMutex.RUnlock()
+	return &RegommendItem{
+		key:         item.key,
+		data:        data,
+		ratedOn:     item.ratedOn,
+		createdOn:   item.createdOn,
+		accessedOn:  item.accessedOn,
+		accessCount: item.AccessCount(),
+		lifeSpan:    item.lifeSpan,
+		norm:        item.norm,
+		hasNorm:     item.hasNorm,
+		meta:        item.Metadata(),
+	}
+}
+
+// Returns when the score for dataKey was given, if it was stored with a
+// timestamp, see RateAt.
+func (item *RegommendItem) RatedOn(dataKey interface{}) (time.Time, bool) {
+	item.RLock()
+	defer item.RUnlock()
+	t, ok := item.ratedOn[dataKey]
+	return t, ok
+}
+
+// Stores an attribute of this item, like a user's segment, under the given
+// key. A nil v removes the attribute. Attributes don't affect
+// recommendations, but can be used by filters, see FilterWithItem.
+func (item *RegommendItem) SetMeta(key string, v interface{}) {
+	item.metaMutex.Lock()
+	defer item.metaMutex.Unlock()
+
+	if v == nil {
+		delete(item.meta, key)
+		return
+	}
+	if item.meta == nil {
+		item.meta = make(map[string]interface{})
+	}
+	item.meta[key] = v
+}
+
+// Returns the attribute of this item stored under the given key, see
+// SetMeta.
+func (item *RegommendItem) Meta(key string) (interface{}, bool) {
+	item.metaMutex.RLock()
+	defer item.metaMutex.RUnlock()
+	v, ok := item.meta[key]
+	return v, ok
+}
+
+// Returns a copy of all attributes of this item, nil if there are none.
+// Useful to carry them over to a new item, e.g. from the callback set by
+// SetAboutToDeleteItemCallback.
+func (item *RegommendItem) Metadata() map[string]interface{} {
+	item.metaMutex.RLock()
+	defer item.metaMutex.RUnlock()
+
+	if len(item.meta) == 0 {
+		return nil
+	}
+	meta := make(map[string]interface{}, len(item.meta))
+	for k, v := range item.meta {
+		meta[k] = v
+	}
+	return meta
 }
 
 // Returns the key of this item.
@@ -39,8 +213,137 @@ func (item *RegommendItem) Key() interface{} {
 	return item.key
 }
 
-// Returns the value of this item.
+// Returns the value of this item. The returned map must not be modified,
+// use the table's Update method instead.
 func (item *RegommendItem) Data() map[interface{}]float64 {
-	// immutable
+	item.RLock()
+	defer item.RUnlock()
+	atomic.StoreInt32(&item.shared, 1)
 	return item.data
 }
+
+// Merges the given data into this item's data. The merged data replaces
+// the old map, so maps previously returned by Data stay untouched. Counts
+// as an access.
+func (item *RegommendItem) merge(data map[interface{}]float64) {
+	item.Lock()
+	defer item.Unlock()
+	item.touch()
+
+	merged := make(map[interface{}]float64, len(item.data)+len(data))
+	for k, v := range item.data {
+		merged[k] = v
+	}
+	for k, v := range data {
+		merged[k] = v
+	}
+	item.data = merged
+	atomic.StoreInt32(&item.shared, 0)
+	item.hasNorm = false
+	item.dropRatedOn(data)
+}
+
+// Adds delta to the score stored for dataKey, a missing score counts as 0.
+// Returns the previous score, if there was one. Like merge, replaces the old
+// map if it may be referenced elsewhere, otherwise modifies it in place, so
+// repeatedly incrementing scores of an item nobody reads meanwhile doesn't
+// copy its data each time.
+func (item *RegommendItem) increment(dataKey interface{}, delta float64) (old float64, ok bool) {
+	item.Lock()
+	defer item.Unlock()
+	item.touch()
+
+	if atomic.LoadInt32(&item.shared) != 0 {
+		data := make(map[interface{}]float64, len(item.data)+1)
+		for k, v := range item.data {
+			data[k] = v
+		}
+		item.data = data
+		atomic.StoreInt32(&item.shared, 0)
+	}
+	old, ok = item.data[dataKey]
+	item.data[dataKey] = old + delta
+	item.hasNorm = false
+	if _, rated := item.ratedOn[dataKey]; rated {
+		item.dropRatedOn(map[interface{}]float64{dataKey: delta})
+	}
+
+	return old, ok
+}
+
+// Replaces this item's data. Timestamps are only kept for unchanged scores.
+// Counts as an access.
+func (item *RegommendItem) replace(data map[interface{}]float64) {
+	item.Lock()
+	defer item.Unlock()
+	item.touch()
+
+	changed := make(map[interface{}]float64)
+	for k := range item.ratedOn {
+		if v, ok := data[k]; !ok || v != item.data[k] {
+			changed[k] = v
+		}
+	}
+	item.dropRatedOn(changed)
+	item.data = data
+	atomic.StoreInt32(&item.shared, 1)
+	item.hasNorm = false
+}
+
+// Stores score for dataKey, given at the given time. Like merge, replaces
+// the old maps, so maps previously returned by Data stay untouched.
+func (item *RegommendItem) rate(dataKey interface{}, score float64, at time.Time) {
+	item.Lock()
+	defer item.Unlock()
+	item.touch()
+
+	data := make(map[interface{}]float64, len(item.data)+1)
+	for k, v := range item.data {
+		data[k] = v
+	}
+	data[dataKey] = score
+	ratedOn := make(map[interface{}]time.Time, len(item.ratedOn)+1)
+	for k, t := range item.ratedOn {
+		ratedOn[k] = t
+	}
+	ratedOn[dataKey] = at
+	item.data = data
+	atomic.StoreInt32(&item.shared, 0)
+	item.ratedOn = ratedOn
+	item.hasNorm = false
+}
+
+// Forgets when the scores for the keys in data were given, as they just got
+// replaced. Callers must hold the item's lock.
+func (item *RegommendItem) dropRatedOn(data map[interface{}]float64) {
+	if len(item.ratedOn) == 0 {
+		return
+	}
+
+	ratedOn := make(map[interface{}]time.Time, len(item.ratedOn))
+	for k, t := range item.ratedOn {
+		if _, ok := data[k]; !ok {
+			ratedOn[k] = t
+		}
+	}
+	item.ratedOn = ratedOn
+}
+
+// Returns the L2 norm of this item's data, computing it only once until the
+// data changes.
+func (item *RegommendItem) l2Norm() float64 {
+	item.RLock()
+	if item.hasNorm {
+		defer item.RUnlock()
+		return item.norm
+	}
+	item.RUnlock()
+
+	item.Lock()
+	defer item.Unlock()
+	if !item.hasNorm {
+		item.norm = l2Norm(item.data)
+		item.hasNorm = true
+	}
+	return item.norm
+}
@@ -9,31 +9,105 @@ package regommend
 
 import (
 	"errors"
-	"log"
-	_ "fmt"
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
-	_ "time"
+	"time"
 )
 
 // Structure of a table with items in the engine.
 type RegommendTable struct {
+	// Identifies the table when locking it along with another one, see
+	// lockBoth. Accessed atomically, so it comes first to be 64-bit aligned
+	// on 32-bit platforms.
+	id uint64
+
 	sync.RWMutex
 
 	// The table's name.
 	name string
 	// All items in the table.
 	items map[interface{}]*RegommendItem
+	// Incremented on every change to the items, see changed.
+	version uint64
+	// The ranked neighbors last computed by NeighborsPage per key, guarded
+	// by their own mutex as they get computed while only holding the
+	// table's read lock.
+	pages      map[interface{}]*neighborsPage
+	pagesMutex sync.Mutex
+	// The transposed view last built by transpose, guarded by its own
+	// mutex as it gets built while only holding the table's read lock.
+	transposed      *transposedView
+	transposedMutex sync.Mutex
+
+	// The expvars published for this table, nil unless registered.
+	vars *tableVars
 
 	// The logger used for this table.
-	logger *log.Logger
+	logger Logger
+	// Whether to log diagnostics while computing similarities.
+	verbose bool
+
+	// How neighbors' scores get combined into recommendations.
+	aggregation Aggregation
+	// Similarity function used to compare items, cosineSim if nil.
+	similarity func(t1, t2 map[interface{}]float64) float64
+	// Whether cosine similarity may use the items' cached norms.
+	assumeNormalized bool
+	// Cached similarities between items, disabled if nil.
+	simCache *similarityCache
+	// Maximum number of cached similarities, a default if zero.
+	simCacheSize int
+	// Shrinks similarities based on few shared keys, disabled if zero.
+	shrinkage float64
+	// Minimum number of keys a neighbor needs to share.
+	minOverlap int
+	// How quickly scores with a timestamp lose weight, disabled if zero.
+	decay time.Duration
+	// Number of goroutines used by RecommendBatch, one per CPU if zero.
+	workers int
+	// Minimum number of neighbors before falling back to popular data
+	// keys, disabled if zero.
+	fallbackMin int
+	// How often each data key got scored, nil unless the fallback is used.
+	popularity map[interface{}]*popularityStats
+
+	// Items not accessed for this long get removed, disabled if zero.
+	ttl time.Duration
+	// Life span given to items added without one, see SetDefaultTTL.
+	defaultTTL time.Duration
+	// Closed to stop the expiration loop, nil while it isn't running.
+	ttlStop chan struct{}
+	// Closed by the expiration loop once it stopped.
+	ttlDone chan struct{}
+	// Wakes the expiration loop to reconsider when the next item expires.
+	ttlWake chan struct{}
 
 	// Callback method triggered when trying to load a non-existing key.
 	loadData func(key interface{}) *RegommendItem
 	// Callback method triggered when adding a new item to the engine.
 	addedItem func(item *RegommendItem)
+	// Decides whether Add may add an item, before adding it.
+	addedItemFilter func(item *RegommendItem) bool
 	// Callback method triggered before deleting an item from the engine.
 	aboutToDeleteItem func(item *RegommendItem)
+	// Decides whether Delete may delete an item, before deleting it.
+	aboutToDeleteFilter func(item *RegommendItem) bool
+	// Callback method triggered after an item expired.
+	expiredItem func(item *RegommendItem)
+}
+
+// Returns the name of this table.
+func (table *RegommendTable) Name() string {
+	table.RLock()
+	defer table.RUnlock()
+	return table.name
 }
 
 // Returns how many items are currently stored in the engine.
@@ -43,6 +117,84 @@ func (table *RegommendTable) Count() int {
 	return len(table.items)
 }
 
+// Returns the keys of all items currently stored in the engine. The slice
+// is a snapshot, callers can range over it without holding any lock, so
+// there's no need to collect keys using Range. The order of the keys is
+// not deterministic.
+func (table *RegommendTable) Keys() []interface{} {
+	table.RLock()
+	defer table.RUnlock()
+
+	keys := make([]interface{}, 0, len(table.items))
+	for k := range table.items {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// Returns all items currently stored in the engine, like Keys. Items are
+// safe to read without holding the table's lock, as maps already returned
+// by their Data method never get modified. The order of the items is not
+// deterministic.
+func (table *RegommendTable) Values() []*RegommendItem {
+	table.RLock()
+	defer table.RUnlock()
+
+	items := make([]*RegommendItem, 0, len(table.items))
+	for _, item := range table.items {
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// Loops over all items in the engine, calling trans for each of them while
+// holding the table's read lock. trans must not call methods modifying the
+// table, as that would deadlock, see Range for a way around that.
+func (table *RegommendTable) Foreach(trans func(key interface{}, item *RegommendItem)) {
+	table.RLock()
+	defer table.RUnlock()
+
+	for k, v := range table.items {
+		trans(k, v)
+	}
+}
+
+// Like Foreach, but works on a snapshot of the table's keys and doesn't hold
+// any lock while calling f, so f may use the table freely. Items deleted in
+// the meantime get skipped, items added in the meantime aren't visited.
+// Stops early once f returns false.
+func (table *RegommendTable) Range(f func(key interface{}, item *RegommendItem) bool) {
+	for _, k := range table.Keys() {
+		table.RLock()
+		item, ok := table.items[k]
+		table.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if !f(k, item) {
+			return
+		}
+	}
+}
+
+// Returns all items pred returns true for, e.g. all items having scored a
+// data key above some threshold. Like Range, pred gets called on a
+// snapshot of the table without holding any lock. The order of the items is
+// not deterministic.
+func (table *RegommendTable) Filter(pred func(key interface{}, item *RegommendItem) bool) []*RegommendItem {
+	matches := []*RegommendItem{}
+	for _, item := range table.Values() {
+		if pred(item.Key(), item) {
+			matches = append(matches, item)
+		}
+	}
+
+	return matches
+}
+
 // Configures a data-loader callback, which will be called when trying
 // to use access a non-existing key.
 func (table *RegommendTable) SetDataLoader(f func(interface{}) *RegommendItem) {
@@ -59,30 +211,188 @@ func (table *RegommendTable) SetAddedItemCallback(f func(*RegommendItem)) {
 	table.addedItem = f
 }
 
+// Configures a filter, which will be called every time a new item is about
+// to be added to the engine, no matter by which method. Returning false
+// aborts adding the item: it doesn't get stored, Add returns nil and the
+// added-item callback doesn't get triggered. Like callbacks, it's called
+// without holding the table's lock.
+func (table *RegommendTable) SetAddedItemFilter(f func(*RegommendItem) bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.addedItemFilter = f
+}
+
 // Configures a callback, which will be called every time an item
-// is about to be removed from the engine.
+// is about to be deleted from the engine. Not called for expired items,
+// see SetExpiredItemCallback.
 func (table *RegommendTable) SetAboutToDeleteItemCallback(f func(*RegommendItem)) {
 	table.Lock()
 	defer table.Unlock()
 	table.aboutToDeleteItem = f
 }
 
-// Sets the logger to be used by this engine table.
-func (table *RegommendTable) SetLogger(logger *log.Logger) {
+// Configures a filter, which will be called every time Delete is about to
+// delete an item from the engine, before the aboutToDeleteItem callback.
+// Returning false cancels the deletion, Delete returns ErrDeleteCanceled.
+// Not called for expired items or by Flush.
+func (table *RegommendTable) SetAboutToDeleteFilter(f func(*RegommendItem) bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.aboutToDeleteFilter = f
+}
+
+// Configures a callback, which will be called every time an item
+// expired and got removed from the engine, see SetTTL and AddWithTTL.
+func (table *RegommendTable) SetExpiredItemCallback(f func(*RegommendItem)) {
+	table.Lock()
+	defer table.Unlock()
+	table.expiredItem = f
+}
+
+// Selects the similarity metric used when computing neighbors and
+// recommendations. Defaults to Cosine.
+func (table *RegommendTable) SetMetric(m Metric) {
+	table.Lock()
+	defer table.Unlock()
+	table.similarity = m.similarityFunc()
+	table.clearSimilarities()
+}
+
+// Configures a custom similarity function used when computing neighbors
+// and recommendations. Higher values mean more similar items. Passing nil
+// restores the default cosine similarity. The function may be invoked
+// concurrently and must not modify the maps passed to it.
+func (table *RegommendTable) SetSimilarityFunc(f func(t1, t2 map[interface{}]float64) float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.similarity = f
+	table.clearSimilarities()
+}
+
+// Deprecated: use SetSimilarityFunc instead.
+func (table *RegommendTable) SetDistanceFunc(f func(t1, t2 map[interface{}]float64) float64) {
+	table.SetSimilarityFunc(f)
+}
+
+// Configures shrinkage of similarities computed on few shared keys. Each
+// similarity gets scaled by n/(n+lambda), where n is the number of keys two
+// items share, so neighbors with little evidence can't dominate those with
+// plenty. A lambda of zero disables shrinkage, which is the default.
+func (table *RegommendTable) SetSimilarityShrinkage(lambda float64) {
+	table.Lock()
+	defer table.Unlock()
+	table.shrinkage = lambda
+}
+
+// Configures the minimum number of keys an item needs to share with the
+// item a query is made for to be considered a neighbor. Items sharing fewer
+// keys are left out of Neighbors and don't contribute to recommendations.
+// Zero, the default, considers all items.
+func (table *RegommendTable) SetMinOverlap(n int) {
+	table.Lock()
+	defer table.Unlock()
+	table.minOverlap = n
+}
+
+// Lets the default cosine similarity use norms cached on each item, rather
+// than recomputing them for every pair of items. Each item's norm is then
+// computed over all of its data, not just the keys shared with the other
+// item, which only ranks neighbors the same way if the items' scores are
+// normalized to the same length. Has no effect on other metrics.
+func (table *RegommendTable) SetAssumeNormalized(normalized bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.assumeNormalized = normalized
+	table.clearSimilarities()
+}
+
+// Configures how many goroutines RecommendBatch spreads its work over.
+// Zero, the default, uses one per CPU.
+func (table *RegommendTable) SetWorkers(n int) {
+	table.Lock()
+	defer table.Unlock()
+	table.workers = n
+}
+
+// Sets the logger to be used by this engine table. Use StdLogger to log to
+// a log.Logger, or SlogLogger for a slog.Logger.
+func (table *RegommendTable) SetLogger(logger Logger) {
 	table.Lock()
 	defer table.Unlock()
 	table.logger = logger
 }
 
+// Enables or disables logging of diagnostics, like the keys shared between
+// two items, while computing neighbors and recommendations.
+func (table *RegommendTable) SetVerbose(verbose bool) {
+	table.Lock()
+	defer table.Unlock()
+	table.verbose = verbose
+}
+
 // Adds a key/value pair to the engine.
 // Parameter key is the item's engine-key.
 // Parameter data is the item's value.
+// The item expires according to the table's default TTL, see SetDefaultTTL.
+// Returns nil if the added-item filter rejected the item, see
+// SetAddedItemFilter.
 func (table *RegommendTable) Add(key interface{}, data map[interface{}]float64) *RegommendItem {
+	return table.add(key, data, 0, true)
+}
+
+// Like Add, but the item expires once it hasn't been accessed for the given
+// duration, overriding the table's TTL. Zero or less never expires it.
+// Returns nil if the item got rejected, just like Add.
+func (table *RegommendTable) AddWithTTL(key interface{}, data map[interface{}]float64, ttl time.Duration) *RegommendItem {
+	return table.add(key, data, ttl, false)
+}
+
+// Asks the added-item filter whether item may be added, see
+// SetAddedItemFilter. Like in add, the filter gets called without holding
+// the table lock: callers must hold it, it gets released while the filter
+// runs and is held again on return. If released is set, callers need to
+// check again whether an item got added for the same key meanwhile.
+func (table *RegommendTable) admit(item *RegommendItem) (admitted bool, released bool) {
+	addedItemFilter := table.addedItemFilter
+	if addedItemFilter == nil {
+		return true, false
+	}
+
+	table.Unlock()
+	admitted = addedItemFilter(item)
+	table.Lock()
+
+	return admitted, true
+}
+
+// Adds an item with the given life span, or the default TTL if useDefault
+// is set.
+func (table *RegommendTable) add(key interface{}, data map[interface{}]float64, lifeSpan time.Duration, useDefault bool) *RegommendItem {
 	item := CreateRegommendItem(key, data)
 
+	table.RLock()
+	if useDefault {
+		lifeSpan = table.defaultTTL
+	}
+	item.lifeSpan = lifeSpan
+	addedItemFilter := table.addedItemFilter
+	table.RUnlock()
+
+	if addedItemFilter != nil && !addedItemFilter(&item) {
+		return nil
+	}
+
 	// Add item to engine.
 	table.Lock()
+	if old, ok := table.items[key]; ok {
+		table.trackPopularity(old.Data(), nil)
+		old.resetAccess()
+	}
+	table.trackPopularity(nil, data)
 	table.items[key] = &item
+	table.changed()
+	table.invalidateSimilarities(key)
+	table.added(&item)
 
 	// engine values so we don't keep blocking the mutex.
 	addedItem := table.addedItem
@@ -96,32 +406,182 @@ func (table *RegommendTable) Add(key interface{}, data map[interface{}]float64)
 	return &item
 }
 
-// Delete an item from the engine.
-func (table *RegommendTable) Delete(key interface{}) (*RegommendItem, error) {
-	table.RLock()
+// Adds a new item with the given key and data, or merges the data into the
+// existing item like Update does. Checking for the item and adding or
+// merging happens atomically, so concurrent callers can stream ratings into
+// the same item without losing any. The added-item callback only gets
+// triggered if a new item was created. Returns nil if the added-item filter
+// rejected the new item, see SetAddedItemFilter.
+func (table *RegommendTable) AddOrUpdate(key interface{}, data map[interface{}]float64) *RegommendItem {
+	table.Lock()
+	r, ok := table.items[key]
+	if ok {
+		// Holding the table lock while locking the item, the lock order
+		// every method needs to keep to avoid deadlocks.
+		old := r.Data()
+		r.merge(data)
+		table.trackPopularity(old, r.Data())
+		table.changed()
+		table.invalidateSimilarities(key)
+		table.Unlock()
+		return r
+	}
+
+	item := CreateRegommendItem(key, data)
+	item.lifeSpan = table.defaultTTL
+	if admitted, released := table.admit(&item); !admitted {
+		table.Unlock()
+		return nil
+	} else if released {
+		if _, ok := table.items[key]; ok {
+			// added meanwhile, merge into that one
+			table.Unlock()
+			return table.AddOrUpdate(key, data)
+		}
+	}
+	table.trackPopularity(nil, data)
+	table.items[key] = &item
+	table.changed()
+	table.added(&item)
+	addedItem := table.addedItem
+	table.Unlock()
+
+	if addedItem != nil {
+		addedItem(&item)
+	}
+
+	return &item
+}
+
+// Merges data into the existing item with the given key. Values for data
+// keys the item already has are overwritten, all other data is kept.
+// Returns an error if the key doesn't exist.
+func (table *RegommendTable) Update(key interface{}, data map[interface{}]float64) (*RegommendItem, error) {
+	table.Lock()
+	defer table.Unlock()
 	r, ok := table.items[key]
 	if !ok {
-		table.RUnlock()
 		return nil, errors.New("Key not found in engine")
 	}
 
+	old := r.Data()
+	r.merge(data)
+	table.trackPopularity(old, r.Data())
+	table.changed()
+	table.invalidateSimilarities(key)
+	return r, nil
+}
+
+// Atomically adds delta to the score stored for dataKey in the item with
+// given key. A missing score counts as 0 and a missing item gets created
+// with just this one score. Returns an error if delta isn't a finite number,
+// ErrAddCanceled if the added-item filter rejected the new item.
+func (table *RegommendTable) IncrementRating(key interface{}, dataKey interface{}, delta float64) error {
+	if math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return errors.New("Invalid rating delta")
+	}
+
+	table.Lock()
+	r, ok := table.items[key]
+	if ok {
+		old, rated := r.increment(dataKey, delta)
+		if table.popularity != nil {
+			// Only track the one score, not to share the item's data.
+			before := map[interface{}]float64{}
+			if rated {
+				before[dataKey] = old
+			}
+			table.trackPopularity(before, map[interface{}]float64{dataKey: old + delta})
+		}
+		table.changed()
+		table.invalidateSimilarities(key)
+		table.Unlock()
+		return nil
+	}
+
+	item := CreateRegommendItem(key, map[interface{}]float64{dataKey: delta})
+	item.lifeSpan = table.defaultTTL
+	if admitted, released := table.admit(&item); !admitted {
+		table.Unlock()
+		return ErrAddCanceled
+	} else if released {
+		if _, ok := table.items[key]; ok {
+			// added meanwhile, increment that one
+			table.Unlock()
+			return table.IncrementRating(key, dataKey, delta)
+		}
+	}
+	table.trackPopularity(nil, item.data)
+	table.items[key] = &item
+	table.changed()
+	table.added(&item)
+	addedItem := table.addedItem
+	table.Unlock()
+
+	if addedItem != nil {
+		addedItem(&item)
+	}
+
+	return nil
+}
+
+var (
+	// Returned when the added-item filter rejected a new item.
+	ErrAddCanceled = errors.New("Adding canceled by filter")
+	// Returned by Delete when the aboutToDeleteFilter canceled the deletion.
+	ErrDeleteCanceled = errors.New("Deletion canceled by filter")
+)
+
+// Delete an item from the engine. The aboutToDeleteItem callback gets
+// triggered for the item actually being removed: if the item gets replaced
+// while the callback runs, the callback gets triggered for the replacement
+// and that one gets deleted instead. Returns ErrDeleteCanceled if the
+// filter kept the item, see SetAboutToDeleteFilter.
+func (table *RegommendTable) Delete(key interface{}) (*RegommendItem, error) {
+	table.RLock()
+	r, ok := table.items[key]
 	// engine value so we don't keep blocking the mutex.
 	aboutToDeleteItem := table.aboutToDeleteItem
+	aboutToDeleteFilter := table.aboutToDeleteFilter
 	table.RUnlock()
 
-	// Trigger callbacks before deleting an item from engine.
-	if aboutToDeleteItem != nil {
-		aboutToDeleteItem(r)
-	}
+	for {
+		if !ok {
+			return nil, errors.New("Key not found in engine")
+		}
+		if aboutToDeleteFilter != nil && !aboutToDeleteFilter(r) {
+			return nil, ErrDeleteCanceled
+		}
 
-	r.RLock()
-	defer r.RUnlock()
+		// Trigger callbacks before deleting an item from engine.
+		if aboutToDeleteItem != nil {
+			aboutToDeleteItem(r)
+		}
 
-	table.Lock()
-	defer table.Unlock()
-	delete(table.items, key)
+		table.Lock()
+		var cur *RegommendItem
+		cur, ok = table.items[key]
+		if ok && cur == r {
+			// Always lock the table before its items, see AddOrUpdate.
+			r.RLock()
+			delete(table.items, key)
+			table.trackPopularity(r.data, nil)
+			r.RUnlock()
+			r.resetAccess()
+			table.changed()
+			table.count("delete")
+			table.invalidateSimilarities(key)
+			table.Unlock()
 
-	return r, nil
+			return r, nil
+		}
+
+		// Deleted or replaced while the callback ran.
+		r = cur
+		aboutToDeleteItem = table.aboutToDeleteItem
+		aboutToDeleteFilter = table.aboutToDeleteFilter
+		table.Unlock()
+	}
 }
 
 // Test whether an item exists in the engine. Unlike the Value method
@@ -140,9 +600,11 @@ func (table *RegommendTable) Value(key interface{}) (*RegommendItem, error) {
 	table.RLock()
 	r, ok := table.items[key]
 	loadData := table.loadData
+	table.count("value")
 	table.RUnlock()
 
 	if ok {
+		r.KeepAlive()
 		return r, nil
 	}
 
@@ -150,8 +612,10 @@ func (table *RegommendTable) Value(key interface{}) (*RegommendItem, error) {
 	if loadData != nil {
 		item := loadData(key)
 		if item != nil {
-			table.Add(key, item.data)
-			return item, nil
+			if r = table.Add(key, item.Data()); r != nil {
+				r.KeepAlive()
+				return r, nil
+			}
 		}
 
 		return nil, errors.New("Key not found and could not be loaded into engine")
@@ -160,123 +624,1066 @@ func (table *RegommendTable) Value(key interface{}) (*RegommendItem, error) {
 	return nil, errors.New("Key not found in engine")
 }
 
-// Delete all items from engine.
+// Delete all items from engine. Stops the expiration loop unless there's a
+// table-wide TTL, adding another item with a TTL starts it again.
 func (table *RegommendTable) Flush() {
 	table.Lock()
 	defer table.Unlock()
 
-	table.log("Flushing table", table.name)
+	table.log("Flushing table", "items", len(table.items))
 
+	for _, r := range table.items {
+		r.resetAccess()
+	}
 	table.items = make(map[interface{}]*RegommendItem)
+	table.rebuildPopularity()
+	table.changed()
+	table.count("flush")
+	table.clearSimilarities()
+	table.resetExpiration()
 }
 
+// A key and its similarity to the key a query was made for.
 type DistancePair struct {
 	Key interface{}
 	Distance float64
+
+	// How many keys both items share, if it was needed.
+	overlap int
 }
+
+// A list of DistancePairs, sortable by descending similarity.
 type DistancePairList []DistancePair
 
 func (p DistancePairList) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 func (p DistancePairList) Len() int { return len(p) }
-func (p DistancePairList) Less(i, j int) bool { return p[i].Distance > p[j].Distance }
+func (p DistancePairList) Less(i, j int) bool { return closer(p[i], p[j]) }
 
-func (table *RegommendTable) Recommend(key interface{}) (DistancePairList, error) {
-	dists, err := table.Neighbors(key)
-	if err != nil {
-		return dists, err
+// Reports whether a ranks before b: more similar first, ties broken by the
+// string form of the keys so the order is deterministic.
+func closer(a, b DistancePair) bool {
+	if a.Distance != b.Distance {
+		return a.Distance > b.Distance
+	}
+
+	return keyString(a.Key) < keyString(b.Key)
+}
+
+// Returns the string form of a key, used to order keys deterministically.
+// Avoids fmt for the most common key types, as ties can be frequent.
+func keyString(k interface{}) string {
+	switch v := k.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	}
+
+	return fmt.Sprint(k)
+}
+
+// A bounded min-heap keeping the closest DistancePairs seen so far, with
+// the least similar one at its root.
+type distanceHeap DistancePairList
+
+func (h distanceHeap) Len() int            { return len(h) }
+func (h distanceHeap) Less(i, j int) bool  { return closer(h[j], h[i]) }
+func (h distanceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *distanceHeap) Push(x interface{}) { *h = append(*h, x.(DistancePair)) }
+func (h *distanceHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Offers a DistancePair to a heap holding at most n entries.
+func (h *distanceHeap) offer(d DistancePair, n int) {
+	if h.Len() < n {
+		heap.Push(h, d)
+	} else if closer(d, (*h)[0]) {
+		(*h)[0] = d
+		heap.Fix(h, 0)
+	}
+}
+
+// A recommended data key and its aggregated score.
+type Recommendation struct {
+	Key   interface{}
+	Score float64
+	// The score before normalizing it, see Normalize.
+	Raw float64
+	// Whether the data key was scored already, see IncludeRated.
+	Rated bool
+	// The actual score given to the data key, if Rated is set.
+	Rating float64
+	// Whether the data key was recommended for its popularity only, see
+	// SetPopularityFallback.
+	Fallback bool
+	// How much of the evidence backs the recommendation, in [0, 1]: the
+	// summed weight of the neighbors who scored the data key, divided by the
+	// summed weight of all neighbors that contributed to any recommendation.
+	// By default a neighbor's weight is its similarity. For RecommendItemBased
+	// it's the summed similarity of the item's data keys to the recommended
+	// one, divided by how many got compared, and for Fallback recommendations
+	// the share of items having scored the data key.
+	Confidence float64
+	// How many neighbors the score is based on, or data keys for
+	// RecommendItemBased, or items having scored the data key for Fallback
+	// recommendations.
+	Contributors int
+}
+
+// A list of Recommendations, sortable by descending score.
+type RecommendationList []Recommendation
+
+func (p RecommendationList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p RecommendationList) Len() int           { return len(p) }
+func (p RecommendationList) Less(i, j int) bool { return better(p[i], p[j]) }
+
+// Reports whether a ranks before b: higher score first, ties broken by the
+// string form of the keys so the order is deterministic.
+func better(a, b Recommendation) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+
+	return keyString(a.Key) < keyString(b.Key)
+}
+
+// A bounded min-heap keeping the best Recommendations seen so far, with
+// the worst one at its root.
+type recommendationHeap RecommendationList
+
+func (h recommendationHeap) Len() int            { return len(h) }
+func (h recommendationHeap) Less(i, j int) bool  { return better(h[j], h[i]) }
+func (h recommendationHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recommendationHeap) Push(x interface{}) { *h = append(*h, x.(Recommendation)) }
+func (h *recommendationHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Offers a Recommendation to a heap holding at most n entries.
+func (h *recommendationHeap) offer(r Recommendation, n int) {
+	if h.Len() < n {
+		heap.Push(h, r)
+	} else if better(r, (*h)[0]) {
+		(*h)[0] = r
+		heap.Fix(h, 0)
 	}
+}
+
+// Recommends data keys the item with the given key doesn't have yet. By
+// default, a recommendation's score predicts the item's score for it: the
+// average of the neighbors' scores, weighted by their similarity, counting
+// only neighbors who scored it. Data keys only scored by neighbors with a
+// similarity of zero or less don't get recommended. See SetAggregation for
+// other ways to combine scores. Returns the n best recommendations, or all of
+// them if n is zero or negative. Recommendations with equal scores are
+// ordered by the string form of their keys. Options like Exclude further
+// restrict what gets recommended.
+func (table *RegommendTable) Recommend(key interface{}, n int, opts ...RecommendOption) (RecommendationList, error) {
 	sitem, err := table.Value(key)
 	if err != nil {
-		return dists, err
+		return RecommendationList{}, err
 	}
-	smap := sitem.Data()
 
+	table.RLock()
+	defer table.RUnlock()
+	recs, _ := table.recommend(key, sitem.Data(), n, newRecommendOptions(opts), nil)
+	return recs, nil
+}
+
+// A key no item in the engine can have, used for ad-hoc profiles.
+type profileKey struct{}
+
+// Like Recommend, but for an ad-hoc profile that isn't stored in the engine,
+// e.g. one built from an anonymous visitor's session. Data keys contained
+// in the profile aren't recommended. The engine isn't modified in any way.
+func (table *RegommendTable) RecommendForProfile(data map[interface{}]float64, n int, opts ...RecommendOption) RecommendationList {
+	table.RLock()
+	defer table.RUnlock()
+	recs, _ := table.recommend(profileKey{}, data, n, newRecommendOptions(opts), nil)
+	return recs
+}
+
+// Computes recommendations for several keys at once. Holds the table's read
+// lock just once and spreads the work over several goroutines, see
+// SetWorkers. Returns the recommendations per key along with the errors for
+// keys that couldn't be found or loaded.
+func (table *RegommendTable) RecommendBatch(keys []interface{}, n int, opts ...RecommendOption) (map[interface{}]RecommendationList, map[interface{}]error) {
+	o := newRecommendOptions(opts)
+	recs := make(map[interface{}]RecommendationList)
+	errs := make(map[interface{}]error)
+
+	// Fetch all items first, the data-loader may need to add them.
+	profiles := make(map[interface{}]map[interface{}]float64)
+	for _, key := range keys {
+		sitem, err := table.Value(key)
+		if err != nil {
+			errs[key] = err
+			continue
+		}
+		profiles[key] = sitem.Data()
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+
+	workers := table.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	// The first panic of any worker, e.g. in a Filter, passed on once all
+	// of them are done.
+	var panicked interface{}
+	failed := false
+	jobs := make(chan interface{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				mutex.Lock()
+				skip := failed
+				mutex.Unlock()
+				if skip {
+					// keep draining jobs, nobody needs the results anymore
+					continue
+				}
+
+				func() {
+					defer func() {
+						if p := recover(); p != nil {
+							mutex.Lock()
+							if !failed {
+								panicked, failed = p, true
+							}
+							mutex.Unlock()
+						}
+					}()
+
+					r, _ := table.recommend(key, profiles[key], n, o, nil)
+
+					mutex.Lock()
+					recs[key] = r
+					mutex.Unlock()
+				}()
+			}
+		}()
+	}
+	for key := range profiles {
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+	if failed {
+		panic(panicked)
+	}
+
+	return recs, errs
+}
+
+// Computes recommendations for the item with the given key and data.
+// Gives up and returns false once done gets closed, a nil done never does.
+// Callers must hold the table lock.
+func (table *RegommendTable) recommend(key interface{}, smap map[interface{}]float64, n int, opts *recommendOptions, done <-chan struct{}) (RecommendationList, bool) {
+	table.count("recommend")
+	opts = opts.forItem(table.items[key])
+	dists, ok := table.neighbors(key, smap, 0, opts.significanceCap > 0, done)
+	if !ok {
+		return RecommendationList{}, false
+	}
+
+	return table.recommendFrom(dists, smap, n, opts, nil, done)
+}
+
+// Aggregates the scores of the given neighbors into recommendations for an
+// item with data smap, see recommend. Unless explain is nil, it collects the
+// neighbors contributing to each data key's score in there, in no particular
+// order. Callers must hold the table lock.
+func (table *RegommendTable) recommendFrom(dists DistancePairList, smap map[interface{}]float64, n int, opts *recommendOptions, explain map[interface{}]ContributorList, done <-chan struct{}) (RecommendationList, bool) {
+	recsList := RecommendationList{}
 	totalDistance := 0.0
 	for _, v := range dists {
-		//fmt.Println("Comparing to", v.Key, "-", v.Distance)
+		table.debug("Comparing to neighbor", "neighbor", v.Key, "similarity", v.Distance)
 		totalDistance += v.Distance
 	}
 
+	if table.fallbackMin > 0 {
+		contributing := 0
+		for _, v := range dists {
+			if table.weight(v, totalDistance, opts) > 0 {
+				contributing++
+			}
+		}
+		if contributing < table.fallbackMin {
+			return table.popular(smap, n, opts), true
+		}
+	}
+
 	recs := make(map[interface{}]float64)
+	// The total weight per data key, for averaging and normalizing.
+	weights := make(map[interface{}]float64)
+	contributors := make(map[interface{}]int)
+	totalWeight := 0.0
+	now := time.Now()
 	for _, v := range dists {
-		weight := v.Distance / totalDistance
+		weight := table.weight(v, totalDistance, opts)
 		if weight <= 0 {
 			continue
 		}
-		if weight > 1 {
-			weight = 1
+		totalWeight += weight
+		if canceled(done) {
+			return recsList, false
 		}
 
-		ditem, _ := table.Value(v.Key)
-		recMap := ditem.Data()
+		recMap := table.decayed(table.items[v.Key], now)
 		for key, x := range recMap {
-			_, ok := smap[key]
-			if ok {
+			if rating, ok := smap[key]; opts.skipRated(rating, ok) {
 				// key already knows this item, don't recommend it
 				continue
 			}
+			if opts.exclude[key] {
+				continue
+			}
 
-			//fmt.Println("Adding to recs:", key)
+			table.debug("Adding to recommendations", "neighbor", v.Key, "dataKey", key)
 			score, ok := recs[key]
 			if ok {
 				recs[key] = score + x * weight
 			} else {
 				recs[key] = x * weight
 			}
+			weights[key] += weight
+			contributors[key]++
+			if explain != nil {
+				explain[key] = append(explain[key], Contributor{
+					Key:          v.Key,
+					Similarity:   v.Distance,
+					Score:        x,
+					Contribution: x * weight,
+				})
+			}
 		}
 	}
 
-	recsList := make(DistancePairList, len(recs))
-	i := 0
-	for key, score := range recs {
-		recsList[i] = DistancePair{
-			Key: key,
-			Distance: score,
+	// Only keep the n best candidates around instead of sorting them all.
+	top := recommendationHeap{}
+	for key, raw := range recs {
+		// weights are positive for every key with a score
+		if table.aggregation == WeightedAverage {
+			raw /= weights[key]
+			for i := range explain[key] {
+				explain[key][i].Contribution /= weights[key]
+			}
 		}
-		i++
+		if opts.dropScore(raw) {
+			continue
+		}
+
+		score := raw
+		// averaged scores are on the rating scale already
+		if opts.normalization == NormalizeRatingScale && table.aggregation != WeightedAverage {
+			score = raw / weights[key]
+		}
+		if opts.filter != nil && !opts.filter(key, score) {
+			continue
+		}
+		r := Recommendation{
+			Key:          key,
+			Score:        score,
+			Raw:          raw,
+			Confidence:   weights[key] / totalWeight,
+			Contributors: contributors[key],
+		}
+		r.Rating, r.Rated = smap[key]
+		if n > 0 {
+			top.offer(r, opts.candidates(n))
+		} else {
+			recsList = append(recsList, r)
+		}
+	}
+	if n > 0 {
+		recsList = RecommendationList(top)
 	}
 	sort.Sort(recsList)
+	if opts.diversity != 0 {
+		recsList = table.diversify(recsList, n, opts.diversity)
+	}
+	if opts.normalization == NormalizeMinMax {
+		normalizeMinMax(recsList)
+	}
 
-	return recsList, nil
+	return recsList, true
 }
 
+// Scales the scores of a list of recommendations to [0, 1], see
+// NormalizeMinMax.
+func normalizeMinMax(recs RecommendationList) {
+	if len(recs) == 0 {
+		return
+	}
+
+	max := recs[0].Score
+	min := recs[0].Score
+	for _, r := range recs {
+		if r.Score > max {
+			max = r.Score
+		}
+		if r.Score < min {
+			min = r.Score
+		}
+	}
+	for i := range recs {
+		if max == min {
+			recs[i].Score = 1
+		} else {
+			recs[i].Score = (recs[i].Score - min) / (max - min)
+		}
+	}
+}
+
+// Returns all other items in the engine along with their similarity to the
+// item with the given key, most similar first. Like Value, this tries to
+// fetch a missing item via the data-loader before giving up.
 func (table *RegommendTable) Neighbors(key interface{}) (DistancePairList, error) {
-	dists := DistancePairList{}
+	return table.NeighborsN(key, 0)
+}
 
+// Like Neighbors, but spreads the work over the given number of goroutines,
+// which pays off for large tables on machines with several CPUs. Returns
+// the same result as Neighbors. Zero or less workers use one per CPU.
+func (table *RegommendTable) NeighborsParallel(key interface{}, workers int) (DistancePairList, error) {
 	sitem, err := table.Value(key)
 	if err != nil {
-		return dists, err
+		return DistancePairList{}, err
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
 	}
-	smap := sitem.Data()
 
 	table.RLock()
 	defer table.RUnlock()
+	distanceTo := table.distanceTo(key, sitem.Data(), false)
+	now := time.Now()
+
+	keys := make([]interface{}, 0, len(table.items))
+	items := make([]*RegommendItem, 0, len(table.items))
 	for k, ditem := range table.items {
-		if err != nil {
+		if k == key || table.expired(ditem, now) {
 			continue
 		}
-		if k == key {
+		keys = append(keys, k)
+		items = append(items, ditem)
+	}
+
+	// Each worker fills its own list, merged once all of them are done.
+	shards := make([]DistancePairList, workers)
+	size := (len(keys) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * size
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if start >= end {
+			break
+		}
+
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			shard := make(DistancePairList, 0, end-start)
+			for i := start; i < end; i++ {
+				if distance, ok := distanceTo(keys[i], items[i]); ok {
+					shard = append(shard, distance)
+				}
+			}
+			shards[w] = shard
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	dists := make(DistancePairList, 0, len(keys))
+	for _, shard := range shards {
+		dists = append(dists, shard...)
+	}
+	sort.Sort(dists)
+
+	return dists, nil
+}
+
+// Like Neighbors, but only returns the n most similar items. Uses a bounded
+// heap instead of sorting all items, which pays off for large tables. Items
+// with equal similarity are ordered by the string form of their keys. A
+// zero or negative n returns all items.
+func (table *RegommendTable) NeighborsN(key interface{}, n int) (DistancePairList, error) {
+	sitem, err := table.Value(key)
+	if err != nil {
+		return DistancePairList{}, err
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	dists, _ := table.neighbors(key, sitem.Data(), n, false, nil)
+	return dists, nil
+}
+
+// Computes the n items most similar to the item with the given key and
+// data, or all of them if n is zero or negative. Gives up and returns false
+// once done gets closed, a nil done never does. With overlap set, the number
+// of keys shared with each neighbor gets recorded, too. Expired items never
+// qualify, even before they got removed. Callers must hold the table lock.
+func (table *RegommendTable) neighbors(key interface{}, smap map[interface{}]float64, n int, overlap bool, done <-chan struct{}) (DistancePairList, bool) {
+	dists := DistancePairList{}
+	distanceTo := table.distanceTo(key, smap, overlap)
+	now := time.Now()
+
+	top := distanceHeap{}
+	for k, ditem := range table.items {
+		if k == key || table.expired(ditem, now) {
 			continue
 		}
+		if canceled(done) {
+			return dists, false
+		}
+
+		distance, ok := distanceTo(k, ditem)
+		if !ok {
+			continue
+		}
+		if n > 0 {
+			top.offer(distance, n)
+		} else {
+			dists = append(dists, distance)
+		}
+	}
+	if n > 0 {
+		dists = DistancePairList(top)
+	}
+	sort.Sort(dists)
+
+	return dists, true
+}
+
+// Returns a function computing the similarity of the item with the given
+// key and data to another item, applying the table's settings. It returns
+// false for items which don't qualify as neighbors. With withOverlap set,
+// it also records how many keys the items share. It's safe to call
+// concurrently. Callers must hold the table lock while using it.
+func (table *RegommendTable) distanceTo(key interface{}, smap map[interface{}]float64, withOverlap bool) func(k interface{}, ditem *RegommendItem) (DistancePair, bool) {
+	sim := table.similarity
+	normalized := sim == nil && table.assumeNormalized && table.decay <= 0
+	if sim == nil {
+		sim = cosineSim
+	}
+	// Ad-hoc profiles have no stable data to cache similarities for, and
+	// decayed ones keep changing.
+	cache := table.simCache
+	if _, ok := key.(profileKey); ok || table.decay > 0 {
+		cache = nil
+	}
+	now := time.Now()
+	if sitem, ok := table.items[key]; ok && table.decay > 0 {
+		smap = table.decayed(sitem, now)
+	}
+	snorm := 0.0
+	if normalized {
+		snorm = l2Norm(smap)
+	}
+	vars := table.vars
+
+	return func(k interface{}, ditem *RegommendItem) (DistancePair, bool) {
+		table.debug("Analyzing", "key", key, "other", k)
+		ddata := table.decayed(ditem, now)
+		if table.verbose {
+			for dk, x := range smap {
+				if y, ok := ddata[dk]; ok {
+					table.debug("Found shared", "dataKey", dk, "score", x, "otherScore", y)
+				}
+			}
+		}
+
+		shared := 0
+		if withOverlap || table.shrinkage > 0 || table.minOverlap > 0 {
+			shared = overlap(smap, ddata)
+		}
+		if shared < table.minOverlap {
+			table.debug("Skipping", "other", k, "shared", shared)
+			return DistancePair{}, false
+		}
 
-		//fmt.Println("Analyzing:", k)
 		distance := DistancePair{
-			Key: k,
-			Distance: cosineSim(smap, ditem.Data()),
+			Key:     k,
+			overlap: shared,
+		}
+		cached := false
+		if cache != nil {
+			distance.Distance, cached = cache.get(key, k)
 		}
-		//fmt.Println("Distance:", distance.Distance)
-		dists = append(dists, distance)
+		if !cached {
+			var start time.Time
+			if vars != nil {
+				start = time.Now()
+			}
+			if normalized {
+				if denominator := snorm * ditem.l2Norm(); denominator != 0 {
+					distance.Distance = dotProduct(smap, ddata) / denominator
+				}
+			} else {
+				distance.Distance = sim(smap, ddata)
+			}
+			if vars != nil {
+				vars.similarityTook(time.Since(start))
+			}
+			if cache != nil {
+				cache.put(key, k, distance.Distance)
+			}
+		}
+		if table.shrinkage > 0 {
+			distance.Distance *= float64(shared) / (float64(shared) + table.shrinkage)
+		}
+		table.debug("Distance", "other", k, "similarity", distance.Distance)
+
+		return distance, true
+	}
+}
+
+// Reports whether done has been closed.
+func canceled(done <-chan struct{}) bool {
+	if done == nil {
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// A ranked list of neighbors, kept around for paging through it.
+type neighborsPage struct {
+	version uint64
+	dists   DistancePairList
+}
+
+// How many keys NeighborsPage keeps rankings around for.
+const maxPages = 16
+
+var (
+	// Returned by NeighborsPage for cursors it didn't create, or created
+	// for another key.
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	// Returned by NeighborsPage for cursors created before the table changed.
+	ErrStaleCursor = errors.New("Cursor is stale, the table changed")
+)
+
+// Pages through the neighbors of the item with the given key, returning at
+// most limit of them along with a cursor for the next page. Pass an empty
+// cursor to get the first page. The order is the one of Neighbors, so pages
+// never overlap, even if similarities tie. The ranking is computed once and
+// reused for following pages, for a few keys at a time. A cursor is only
+// valid for the key it was returned for. Once the table changes in any way,
+// even by adding an unrelated item, all cursors handed out before become
+// stale. The returned cursor is empty after the last page.
+func (table *RegommendTable) NeighborsPage(key interface{}, cursor string, limit int) (DistancePairList, string, error) {
+	offset := 0
+	var version uint64
+	if cursor != "" {
+		b, err := base64.URLEncoding.DecodeString(cursor)
+		if err != nil {
+			return DistancePairList{}, "", ErrInvalidCursor
+		}
+		fields := strings.SplitN(string(b), ":", 3)
+		if len(fields) != 3 || fields[2] != cursorKey(key) {
+			return DistancePairList{}, "", ErrInvalidCursor
+		}
+		if _, err := fmt.Sscanf(fields[0]+":"+fields[1], "%d:%d", &version, &offset); err != nil || offset < 0 {
+			return DistancePairList{}, "", ErrInvalidCursor
+		}
+	}
+
+	sitem, err := table.Value(key)
+	if err != nil {
+		return DistancePairList{}, "", err
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	if cursor != "" && version != table.version {
+		return DistancePairList{}, "", ErrStaleCursor
+	}
+
+	table.pagesMutex.Lock()
+	p := table.pages[key]
+	table.pagesMutex.Unlock()
+	if p == nil || p.version != table.version {
+		dists, _ := table.neighbors(key, sitem.Data(), 0, false, nil)
+		p = &neighborsPage{
+			version: table.version,
+			dists:   dists,
+		}
+		table.storePage(key, p)
+	}
+
+	if offset >= len(p.dists) {
+		return DistancePairList{}, "", nil
+	}
+	end := offset + limit
+	if limit <= 0 || end > len(p.dists) {
+		end = len(p.dists)
+	}
+	page := make(DistancePairList, end-offset)
+	copy(page, p.dists[offset:end])
+
+	next := ""
+	if end < len(p.dists) {
+		next = base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%s", p.version, end, cursorKey(key))))
+	}
+
+	return page, next, nil
+}
+
+// Returns the form of key stored in NeighborsPage cursors, telling apart
+// keys of different types with the same string form.
+func cursorKey(key interface{}) string {
+	return fmt.Sprintf("%T:%s", key, keyString(key))
+}
+
+// Keeps the ranking p computed for key around, see NeighborsPage. Makes room
+// by dropping stale rankings first, then an arbitrary one. Callers must hold
+// the table lock.
+func (table *RegommendTable) storePage(key interface{}, p *neighborsPage) {
+	table.pagesMutex.Lock()
+	defer table.pagesMutex.Unlock()
+
+	if table.pages == nil {
+		table.pages = make(map[interface{}]*neighborsPage)
+	}
+	if _, ok := table.pages[key]; !ok && len(table.pages) >= maxPages {
+		for k, old := range table.pages {
+			if old.version != table.version {
+				delete(table.pages, k)
+			}
+		}
+		for k := range table.pages {
+			if len(table.pages) < maxPages {
+				break
+			}
+			delete(table.pages, k)
+		}
+	}
+	table.pages[key] = p
+}
+
+// Returns the data keys most similar to the given data key, judged by how
+// all items in the table scored them. Uses adjusted cosine similarity, which
+// centers every score by the mean score of its item.
+func (table *RegommendTable) ItemNeighbors(dataKey interface{}) (DistancePairList, error) {
+	dists := DistancePairList{}
+
+	table.RLock()
+	defer table.RUnlock()
+
+	columns, means := table.transpose()
+	scol, ok := columns[dataKey]
+	if !ok {
+		return dists, errors.New("Data key not found in engine")
+	}
+
+	for k, dcol := range columns {
+		if k == dataKey {
+			continue
+		}
+
+		dists = append(dists, DistancePair{
+			Key:      k,
+			Distance: adjustedCosineSim(scol, dcol, means),
+		})
 	}
 	sort.Sort(dists)
 
 	return dists, nil
 }
 
+// Returns the n data keys most similar to the given data key, or all of them
+// if n is zero or negative, for "more like this" features. Like
+// ItemNeighbors, data keys get compared by how all items scored them, but
+// using the table's configured similarity metric. Data keys no item scored
+// along with the given one are left out. Results are cached until the table
+// or its metric changes.
+func (table *RegommendTable) SimilarItems(dataKey interface{}, n int) (DistancePairList, error) {
+	table.RLock()
+	defer table.RUnlock()
+
+	columns, _ := table.transpose()
+	scol, ok := columns[dataKey]
+	if !ok {
+		return DistancePairList{}, errors.New("Data key not found in engine")
+	}
+
+	table.transposedMutex.Lock()
+	v := table.transposed
+	dists, ok := v.similar[dataKey]
+	table.transposedMutex.Unlock()
+	if !ok {
+		sim := table.similarity
+		if sim == nil {
+			sim = cosineSim
+		}
+
+		dists = DistancePairList{}
+		for k, dcol := range columns {
+			if k == dataKey || overlap(scol, dcol) == 0 {
+				continue
+			}
+
+			dists = append(dists, DistancePair{
+				Key:      k,
+				Distance: sim(scol, dcol),
+			})
+		}
+		sort.Sort(dists)
+
+		table.transposedMutex.Lock()
+		if v.similar == nil {
+			v.similar = make(map[interface{}]DistancePairList)
+		}
+		v.similar[dataKey] = dists
+		table.transposedMutex.Unlock()
+	}
+
+	if n > 0 && len(dists) > n {
+		dists = dists[:n]
+	}
+	// the cached list must not be modified
+	return append(DistancePairList{}, dists...), nil
+}
+
+// Recommends data keys the item with the given key hasn't scored yet, based
+// on how similar they are to the data keys it did score, see ItemNeighbors.
+// Each recommendation's score is the average of the item's scores, weighted
+// by the similarity of the scored data keys. Data keys without any positive
+// similarity to a scored one are never recommended. Scales better than
+// Recommend if there are many more items than data keys.
+func (table *RegommendTable) RecommendItemBased(key interface{}, n int, opts ...RecommendOption) (RecommendationList, error) {
+	sitem, err := table.Value(key)
+	if err != nil {
+		return RecommendationList{}, err
+	}
+	o := newRecommendOptions(opts).forItem(sitem)
+	smap := sitem.Data()
+
+	table.RLock()
+	defer table.RUnlock()
+	columns, means := table.transpose()
+
+	recsList := RecommendationList{}
+	top := recommendationHeap{}
+	for k, col := range columns {
+		if rating, ok := smap[k]; o.skipRated(rating, ok) {
+			continue
+		}
+		if o.exclude[k] {
+			continue
+		}
+
+		sum := 0.0
+		totalSim := 0.0
+		compared := 0
+		contributors := 0
+		for rk, x := range smap {
+			if rk == k {
+				// predict scored data keys from the other ones only
+				continue
+			}
+			rcol, ok := columns[rk]
+			if !ok {
+				continue
+			}
+			sim := adjustedCosineSim(col, rcol, means)
+			compared++
+			if sim <= 0 {
+				continue
+			}
+			sum += sim * x
+			totalSim += sim
+			contributors++
+		}
+		if totalSim == 0 {
+			continue
+		}
+
+		score := sum / totalSim
+		if o.dropScore(score) {
+			continue
+		}
+		if o.filter != nil && !o.filter(k, score) {
+			continue
+		}
+		r := Recommendation{
+			Key:          k,
+			Score:        score,
+			Raw:          score,
+			Confidence:   totalSim / float64(compared),
+			Contributors: contributors,
+		}
+		r.Rating, r.Rated = smap[k]
+		if n > 0 {
+			top.offer(r, o.candidates(n))
+		} else {
+			recsList = append(recsList, r)
+		}
+	}
+	if n > 0 {
+		recsList = RecommendationList(top)
+	}
+	sort.Sort(recsList)
+	if o.diversity != 0 {
+		recsList = table.diversify(recsList, n, o.diversity)
+	}
+	if o.normalization == NormalizeMinMax {
+		normalizeMinMax(recsList)
+	}
+
+	return recsList, nil
+}
+
+// The transposed view of a table, see transpose.
+type transposedView struct {
+	version uint64
+	columns map[interface{}]map[interface{}]float64
+	means   map[interface{}]float64
+	// The ranked results of SimilarItems, by data key.
+	similar map[interface{}]DistancePairList
+}
+
+// Returns the transposed view of the table, mapping each data key to the
+// scores all items gave it, along with the mean score of every item that
+// scored more than one data key. The view is built lazily and reused until
+// the table changes. It must not be modified. Callers must hold the table
+// lock.
+func (table *RegommendTable) transpose() (map[interface{}]map[interface{}]float64, map[interface{}]float64) {
+	table.transposedMutex.Lock()
+	defer table.transposedMutex.Unlock()
+
+	v := table.transposed
+	if v == nil || v.version != table.version {
+		columns, means := table.buildTransposed()
+		v = &transposedView{
+			version: table.version,
+			columns: columns,
+			means:   means,
+		}
+		table.transposed = v
+	}
+
+	return v.columns, v.means
+}
+
+// Builds the transposed view of the table, see transpose.
+func (table *RegommendTable) buildTransposed() (map[interface{}]map[interface{}]float64, map[interface{}]float64) {
+	columns := make(map[interface{}]map[interface{}]float64)
+	means := make(map[interface{}]float64)
+
+	for k, item := range table.items {
+		data := item.Data()
+		sum := 0.0
+		for dk, x := range data {
+			col, ok := columns[dk]
+			if !ok {
+				col = make(map[interface{}]float64)
+				columns[dk] = col
+			}
+			col[k] = x
+			sum += x
+		}
+		if len(data) > 1 {
+			means[k] = sum / float64(len(data))
+		}
+	}
+
+	return columns, means
+}
+
+// An item and its similarity to the item a query was made for.
+type ScoredItem struct {
+	Item  *RegommendItem
+	Score float64
+}
+
+// Returns the n items most similar to the item with the given key, most
+// similar first. The item itself is never part of the result. Returns all
+// other items if n is zero or negative or exceeds their count.
+func (table *RegommendTable) NeighborItems(key interface{}, n int) ([]*RegommendItem, error) {
+	scored, err := table.NeighborItemsWithScores(key, n)
+	items := make([]*RegommendItem, len(scored))
+	for i, v := range scored {
+		items[i] = v.Item
+	}
+
+	return items, err
+}
+
+// Like NeighborItems, but also returns each item's similarity, so callers
+// can display or threshold it without computing it again.
+func (table *RegommendTable) NeighborItemsWithScores(key interface{}, n int) ([]ScoredItem, error) {
+	items := []ScoredItem{}
+
+	dists, err := table.NeighborsN(key, n)
+	if err != nil {
+		return items, err
+	}
+
+	table.RLock()
+	defer table.RUnlock()
+	for _, v := range dists {
+		if n > 0 && len(items) >= n {
+			break
+		}
+		item, ok := table.items[v.Key]
+		if !ok {
+			// deleted since computing the neighbors
+			continue
+		}
+		items = append(items, ScoredItem{
+			Item:  item,
+			Score: v.Distance,
+		})
+	}
+
+	return items, nil
+}
+
+// Internal logging method for diagnostics, only active in verbose mode.
+func (table *RegommendTable) debug(msg string, args ...interface{}) {
+	if !table.verbose {
+		return
+	}
+
+	table.logAt(LevelDebug, msg, args...)
+}
+
 // Internal logging method for convenience.
-func (table *RegommendTable) log(v ...interface{}) {
+func (table *RegommendTable) log(msg string, args ...interface{}) {
+	table.logAt(LevelInfo, msg, args...)
+}
+
+// Logs msg with the given key-value pairs, prefixed by the table's name.
+func (table *RegommendTable) logAt(level, msg string, args ...interface{}) {
 	if table.logger == nil {
 		return
 	}
 
-	table.logger.Println(v...)
+	table.logger.Log(level, msg, append([]interface{}{"table", table.name}, args...)...)
 }
@@ -0,0 +1,200 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"container/list"
+	"sync"
+)
+
+// How many similarities a cache holds unless configured otherwise.
+const defaultSimilarityCacheSize = 100000
+
+// The key of a cached similarity. Pairs are ordered, as similarities such as
+// the default cosine similarity aren't symmetric.
+type similarityPair struct {
+	from interface{}
+	to   interface{}
+}
+
+// A cached similarity.
+type similarityEntry struct {
+	pair     similarityPair
+	distance float64
+}
+
+// A bounded cache of similarities between pairs of items, evicting the
+// oldest entries once full.
+type similarityCache struct {
+	sync.Mutex
+
+	// Maximum number of entries.
+	size int
+	// All entries, oldest first.
+	order   *list.List
+	entries map[similarityPair]*list.Element
+	// The pairs each key is part of, for invalidating them.
+	pairs map[interface{}]map[similarityPair]bool
+}
+
+// Returns a new, empty cache holding at most size entries.
+func newSimilarityCache(size int) *similarityCache {
+	return &similarityCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[similarityPair]*list.Element),
+		pairs:   make(map[interface{}]map[similarityPair]bool),
+	}
+}
+
+// Returns the cached similarity of the given pair, if any.
+func (c *similarityCache) get(from, to interface{}) (float64, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[similarityPair{from, to}]
+	if !ok {
+		return 0, false
+	}
+	return e.Value.(*similarityEntry).distance, true
+}
+
+// Caches the similarity of the given pair, evicting the oldest entries if
+// the cache is full.
+func (c *similarityCache) put(from, to interface{}, distance float64) {
+	c.Lock()
+	defer c.Unlock()
+
+	p := similarityPair{from, to}
+	if e, ok := c.entries[p]; ok {
+		e.Value.(*similarityEntry).distance = distance
+		return
+	}
+
+	for c.order.Len() > 0 && c.order.Len() >= c.size {
+		c.remove(c.order.Front())
+	}
+
+	c.entries[p] = c.order.PushBack(&similarityEntry{
+		pair:     p,
+		distance: distance,
+	})
+	c.index(from, p)
+	c.index(to, p)
+}
+
+// Drops all cached similarities involving the given key.
+func (c *similarityCache) invalidate(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	for p := range c.pairs[key] {
+		c.remove(c.entries[p])
+	}
+}
+
+// Drops all cached similarities.
+func (c *similarityCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[similarityPair]*list.Element)
+	c.pairs = make(map[interface{}]map[similarityPair]bool)
+}
+
+// Returns how many similarities are cached.
+func (c *similarityCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// Remembers that key is part of the given pair. Callers must hold the
+// cache's lock.
+func (c *similarityCache) index(key interface{}, p similarityPair) {
+	ps, ok := c.pairs[key]
+	if !ok {
+		ps = make(map[similarityPair]bool)
+		c.pairs[key] = ps
+	}
+	ps[p] = true
+}
+
+// Removes an entry from the cache. Callers must hold the cache's lock.
+func (c *similarityCache) remove(e *list.Element) {
+	p := c.order.Remove(e).(*similarityEntry).pair
+	delete(c.entries, p)
+	for _, key := range []interface{}{p.from, p.to} {
+		delete(c.pairs[key], p)
+		if len(c.pairs[key]) == 0 {
+			delete(c.pairs, key)
+		}
+	}
+}
+
+// Enables or disables caching the similarities computed between items, so
+// repeatedly asking for the neighbors of the same keys doesn't compute them
+// again. Cached similarities of an item get dropped whenever it's added,
+// updated or deleted. See SetSimilarityCacheSize for bounding the cache.
+func (table *RegommendTable) SetSimilarityCache(enabled bool) {
+	table.Lock()
+	defer table.Unlock()
+
+	if !enabled {
+		table.simCache = nil
+		return
+	}
+	if table.simCache == nil {
+		size := table.simCacheSize
+		if size <= 0 {
+			size = defaultSimilarityCacheSize
+		}
+		table.simCache = newSimilarityCache(size)
+	}
+}
+
+// Configures how many similarities the cache holds at most, evicting the
+// oldest ones once full. Zero or less restores the default of 100000.
+func (table *RegommendTable) SetSimilarityCacheSize(n int) {
+	table.Lock()
+	defer table.Unlock()
+
+	table.simCacheSize = n
+	if table.simCache != nil {
+		size := n
+		if size <= 0 {
+			size = defaultSimilarityCacheSize
+		}
+		// start over rather than evicting on the fly
+		table.simCache = newSimilarityCache(size)
+	}
+}
+
+// Drops the cached similarities of the item with the given key, if the
+// cache is enabled. Callers must hold the table lock.
+func (table *RegommendTable) invalidateSimilarities(key interface{}) {
+	if table.simCache != nil {
+		table.simCache.invalidate(key)
+	}
+}
+
+// Drops all cached similarities, including those of SimilarItems. Callers
+// must hold the table lock.
+func (table *RegommendTable) clearSimilarities() {
+	if table.simCache != nil {
+		table.simCache.clear()
+	}
+
+	// The metric might have changed, too.
+	table.transposedMutex.Lock()
+	if table.transposed != nil {
+		table.transposed.similar = nil
+	}
+	table.transposedMutex.Unlock()
+}
@@ -8,26 +8,119 @@
 package regommend
 
 import (
-	_ "errors"
-	_ "log"
-	_ "fmt"
 	"math"
+	"sort"
 )
 
+// Metric selects the similarity function a table uses to compare items.
+type Metric int
+
+const (
+	// Cosine similarity, the default metric.
+	Cosine Metric = iota
+	// Pearson correlation, which compensates for different rating baselines.
+	Pearson
+	// Jaccard index of the item keys, for binary or implicit feedback.
+	Jaccard
+	// Euclidean distance, for dense ratings where magnitude matters.
+	Euclidean
+	// Manhattan distance, less sensitive to single outlier ratings.
+	Manhattan
+	// Tanimoto coefficient, a weighted variant of Jaccard.
+	Tanimoto
+	// Spearman rank correlation, for ordinal ratings.
+	Spearman
+)
+
+// Returns the similarity function implementing the given metric, nil for
+// the table's default cosine similarity.
+func (m Metric) similarityFunc() func(t1, t2 map[interface{}]float64) float64 {
+	switch m {
+	case Pearson:
+		return PearsonSim
+	case Jaccard:
+		return JaccardSim
+	case Euclidean:
+		return EuclideanSim
+	case Manhattan:
+		return manhattanSim
+	case Tanimoto:
+		return tanimotoSim
+	case Spearman:
+		return spearmanSim
+	default:
+		return nil
+	}
+}
+
+// Returns the dot product of two items, iterating the smaller one.
+func dotProduct(t1, t2 map[interface{}]float64) float64 {
+	if len(t2) < len(t1) {
+		t1, t2 = t2, t1
+	}
+
+	sum := 0.0
+	for key, x := range t1 {
+		if y, ok := t2[key]; ok {
+			sum += x * y
+		}
+	}
+
+	return sum
+}
+
+// Returns the L2 norm of an item.
+func l2Norm(t map[interface{}]float64) float64 {
+	sum := 0.0
+	for _, x := range t {
+		sum += x * x
+	}
+
+	return math.Sqrt(sum)
+}
+
+// Computes the cosine similarity of t1 over the keys it shares with t2. All
+// of t1's scores make up its norm, but only the shared ones make up t2's.
+// Probes the bigger map for the keys of the smaller one, and skips computing
+// the norms if no keys are shared at all.
 func cosineSim(t1, t2 map[interface{}]float64) float64 {
 	sum_xy := 0.0
 	sum_x2 := 0.0
 	sum_y2 := 0.0
+	shared := 0
 
-	for key, x := range t1 {
-		y, _ := t2[key]
-		{
-//			fmt.Println("Found shared:", key, x, y)
+	if len(t1) <= len(t2) {
+		for key, x := range t1 {
+			sum_x2 += x * x
+			y, ok := t2[key]
+			if !ok {
+				continue
+			}
 
+			shared++
 			sum_xy += x * y
-			sum_x2 += math.Pow(x, 2)
-			sum_y2 += math.Pow(y, 2)
+			sum_y2 += y * y
+		}
+	} else {
+		for key, y := range t2 {
+			x, ok := t1[key]
+			if !ok {
+				continue
+			}
+
+			shared++
+			sum_xy += x * y
+			sum_y2 += y * y
+		}
+		if shared == 0 {
+			return 0
 		}
+		for _, x := range t1 {
+			sum_x2 += x * x
+		}
+	}
+	if shared == 0 {
+		return 0
 	}
 
 	denominator := math.Sqrt(sum_x2) * math.Sqrt(sum_y2)
@@ -38,38 +131,259 @@ func cosineSim(t1, t2 map[interface{}]float64) float64 {
 	return sum_xy / denominator
 }
 
-func pearsonSim(t1, t2 map[interface{}]float64) float64 {
-	sum_xy := 0.0
+// Computes the Pearson correlation of two items over their co-rated keys,
+// a value in [-1, 1]. Each side is mean-centered over the shared keys only,
+// so two items rating the same things in the same order on shifted scales
+// correlate perfectly. Returns 0 if fewer than two keys are shared or either
+// side has no variance. Can be passed to SetSimilarityFunc.
+func PearsonSim(t1, t2 map[interface{}]float64) float64 {
 	sum_x := 0.0
 	sum_y := 0.0
-	sum_x2 := 0.0
-	sum_y2 := 0.0
 	n := 0.0
 
 	for key, x := range t1 {
 		y, ok := t2[key]
 		if ok {
-//			fmt.Println("Found shared:", key, x, y)
 			n++
-
-			sum_xy += x * y
 			sum_x += x
 			sum_y += y
-			sum_x2 += math.Pow(x, 2)
-			sum_y2 += math.Pow(y, 2)
 		}
 	}
 
-	if n == 0 {
-		// no common items found
+	if n < 2 {
+		// not enough common items for a meaningful correlation
 		return 0
 	}
 
-	denominator := (math.Sqrt(sum_x2 - math.Pow(sum_x, 2) / n) *
-					math.Sqrt(sum_y2 - math.Pow(sum_y, 2) / n))
+	mean_x := sum_x / n
+	mean_y := sum_y / n
+
+	sum_xy := 0.0
+	sum_x2 := 0.0
+	sum_y2 := 0.0
+	for key, x := range t1 {
+		y, ok := t2[key]
+		if ok {
+			dx := x - mean_x
+			dy := y - mean_y
+
+			sum_xy += dx * dy
+			sum_x2 += dx * dx
+			sum_y2 += dy * dy
+		}
+	}
+
+	denominator := math.Sqrt(sum_x2) * math.Sqrt(sum_y2)
 	if denominator == 0 {
 		return 0
 	}
 
-	return (sum_xy - (sum_x * sum_y) / n) / denominator
+	return sum_xy / denominator
+}
+
+// Computes the Jaccard index of two items, the number of shared keys
+// divided by the number of distinct keys in both. Any non-zero score counts
+// as present, its magnitude is ignored, which suits implicit feedback like
+// views or purchases. Returns 0 if neither item has a non-zero score. Can be
+// passed to SetSimilarityFunc.
+func JaccardSim(t1, t2 map[interface{}]float64) float64 {
+	n1 := 0
+	shared := 0
+	for key, x := range t1 {
+		if x == 0 {
+			continue
+		}
+		n1++
+		if y := t2[key]; y != 0 {
+			shared++
+		}
+	}
+
+	n2 := 0
+	for _, y := range t2 {
+		if y != 0 {
+			n2++
+		}
+	}
+
+	union := n1 + n2 - shared
+	if union == 0 {
+		return 0
+	}
+
+	return float64(shared) / float64(union)
+}
+
+// Computes a similarity in [0,1] from the Euclidean distance d of two items
+// as 1/(1+d), so identical items score 1 and distant ones approach 0. Only
+// shared keys contribute to d, keys present in just one of the items are
+// ignored. Returns 0 if no keys are shared. Can be passed to
+// SetSimilarityFunc.
+func EuclideanSim(t1, t2 map[interface{}]float64) float64 {
+	sum_d2 := 0.0
+	shared := false
+
+	for key, x := range t1 {
+		y, ok := t2[key]
+		if ok {
+			shared = true
+			sum_d2 += math.Pow(x-y, 2)
+		}
+	}
+
+	if !shared {
+		return 0
+	}
+
+	return 1 / (1 + math.Sqrt(sum_d2))
+}
+
+// Computes a similarity in [0,1] from the Manhattan distance d of two items
+// as 1/(1+d). Only shared keys contribute to d. Returns 0 if no keys are
+// shared.
+func manhattanSim(t1, t2 map[interface{}]float64) float64 {
+	sum_d := 0.0
+	shared := false
+
+	for key, x := range t1 {
+		y, ok := t2[key]
+		if ok {
+			shared = true
+			sum_d += math.Abs(x - y)
+		}
+	}
+
+	if !shared {
+		return 0
+	}
+
+	return 1 / (1 + sum_d)
+}
+
+// Computes the Tanimoto coefficient of two items, which like Jaccard relates
+// their overlap to their union but respects the scores:
+// sum(x*y) / (sum(x^2) + sum(y^2) - sum(x*y)). Unlike cosineSim the norms
+// cover all keys of both items, not just the shared ones.
+func tanimotoSim(t1, t2 map[interface{}]float64) float64 {
+	sum_xy := 0.0
+	sum_x2 := 0.0
+	sum_y2 := 0.0
+
+	for key, x := range t1 {
+		sum_xy += x * t2[key]
+		sum_x2 += x * x
+	}
+	for _, y := range t2 {
+		sum_y2 += y * y
+	}
+
+	denominator := sum_x2 + sum_y2 - sum_xy
+	if denominator == 0 {
+		return 0
+	}
+
+	return sum_xy / denominator
+}
+
+// Computes the Spearman rank correlation of two items over their co-rated
+// keys, the Pearson correlation of the ranks of their scores. Tied scores
+// get the average of their ranks. Returns 0 if fewer than three keys are
+// shared or either side scored all of them the same.
+func spearmanSim(t1, t2 map[interface{}]float64) float64 {
+	keys := []interface{}{}
+	for key := range t1 {
+		if _, ok := t2[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) < 3 {
+		return 0
+	}
+
+	return PearsonSim(ranks(keys, t1), ranks(keys, t2))
+}
+
+// Ranks the scores of the given keys in ascending order, starting at 1.
+// Tied scores share the average of the ranks they span.
+func ranks(keys []interface{}, scores map[interface{}]float64) map[interface{}]float64 {
+	sorted := make([]interface{}, len(keys))
+	copy(sorted, keys)
+	sort.Sort(byScore{sorted, scores})
+
+	r := make(map[interface{}]float64, len(keys))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && scores[sorted[j]] == scores[sorted[i]] {
+			j++
+		}
+		// positions i..j-1 are tied, ranks i+1..j
+		rank := float64(i+1+j) / 2
+		for ; i < j; i++ {
+			r[sorted[i]] = rank
+		}
+	}
+
+	return r
+}
+
+// Sorts keys by ascending score.
+type byScore struct {
+	keys   []interface{}
+	scores map[interface{}]float64
+}
+
+func (b byScore) Len() int           { return len(b.keys) }
+func (b byScore) Swap(i, j int)      { b.keys[i], b.keys[j] = b.keys[j], b.keys[i] }
+func (b byScore) Less(i, j int) bool { return b.scores[b.keys[i]] < b.scores[b.keys[j]] }
+
+// Computes the adjusted cosine similarity of two data keys, given as maps
+// from item keys to scores. Each score is centered by the mean score of the
+// item it belongs to before the dot product, so generous raters don't
+// dominate. Items without an entry in means are skipped, which callers use
+// to leave out items with a single score, as those always center to zero.
+func adjustedCosineSim(t1, t2, means map[interface{}]float64) float64 {
+	sum_xy := 0.0
+	sum_x2 := 0.0
+	sum_y2 := 0.0
+
+	for key, x := range t1 {
+		y, ok := t2[key]
+		if !ok {
+			continue
+		}
+		mean, ok := means[key]
+		if !ok {
+			continue
+		}
+
+		dx := x - mean
+		dy := y - mean
+		sum_xy += dx * dy
+		sum_x2 += dx * dx
+		sum_y2 += dy * dy
+	}
+
+	denominator := math.Sqrt(sum_x2) * math.Sqrt(sum_y2)
+	if denominator == 0 {
+		return 0
+	}
+
+	return sum_xy / denominator
+}
+
+// Returns the number of keys two items share.
+func overlap(t1, t2 map[interface{}]float64) int {
+	if len(t2) < len(t1) {
+		t1, t2 = t2, t1
+	}
+
+	n := 0
+	for key := range t1 {
+		if _, ok := t2[key]; ok {
+			n++
+		}
+	}
+
+	return n
 }
@@ -0,0 +1,307 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestPearsonShiftedScales(t *testing.T) {
+	generous := map[interface{}]float64{"a": 8.0, "b": 9.0, "c": 10.0}
+	strict := map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 3.0}
+
+	p := PearsonSim(generous, strict)
+	if math.Abs(p-1.0) > 1e-9 {
+		t.Error("Expected pearson similarity of 1.0, got", p)
+	}
+	c := cosineSim(generous, strict)
+	if c > 0.97 {
+		t.Error("Expected cosine similarity to be noticeably lower, got", c)
+	}
+}
+
+func TestPearsonDegenerate(t *testing.T) {
+	empty := map[interface{}]float64{}
+	single := map[interface{}]float64{"a": 5.0}
+	flat := map[interface{}]float64{"a": 3.0, "b": 3.0, "c": 3.0}
+	varied := map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 5.0}
+
+	cases := []struct {
+		name   string
+		t1, t2 map[interface{}]float64
+	}{
+		{"empty", empty, empty},
+		{"one empty", empty, varied},
+		{"single shared", single, varied},
+		{"zero variance", flat, varied},
+		{"zero variance reversed", varied, flat},
+	}
+	for _, c := range cases {
+		p := PearsonSim(c.t1, c.t2)
+		if p != 0 {
+			t.Error("Expected 0 for", c.name, "got", p)
+		}
+	}
+}
+
+func TestSimilarityIsSilent(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	t1 := map[interface{}]float64{"a": 5.0, "b": 4.0, "c": 3.0}
+	t2 := map[interface{}]float64{"a": 4.0, "b": 3.0, "d": 1.0}
+	cosineSim(t1, t2)
+	PearsonSim(t1, t2)
+
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	if len(out) > 0 {
+		t.Errorf("Expected no output on stdout, got %q", out)
+	}
+}
+
+func TestJaccard(t *testing.T) {
+	t1 := map[interface{}]float64{"a": 1.0, "b": 1.0, "c": 1.0}
+	t2 := map[interface{}]float64{"a": 1.0, "b": 1.0, "d": 1.0}
+
+	if j := JaccardSim(t1, t2); j != 0.5 {
+		t.Error("Expected jaccard similarity of 0.5, got", j)
+	}
+	if j := JaccardSim(t1, t1); j != 1.0 {
+		t.Error("Expected jaccard similarity of 1.0, got", j)
+	}
+	if j := JaccardSim(t1, map[interface{}]float64{"a": 0.2, "b": 3.0, "c": 5.0}); j != 1.0 {
+		t.Error("Expected magnitudes to be ignored, got", j)
+	}
+	if j := JaccardSim(t1, map[interface{}]float64{"x": 1.0, "y": 1.0}); j != 0 {
+		t.Error("Expected jaccard similarity of 0 for disjoint items, got", j)
+	}
+	if j := JaccardSim(map[interface{}]float64{}, map[interface{}]float64{}); j != 0 {
+		t.Error("Expected jaccard similarity of 0 for empty items, got", j)
+	}
+
+	// zero scores mark absent keys
+	purchased := map[interface{}]float64{"a": 1.0, "b": 0.0, "c": 1.0}
+	if j := JaccardSim(purchased, t2); j != 0.25 {
+		t.Error("Expected jaccard similarity of 0.25, got", j)
+	}
+	none := map[interface{}]float64{"a": 0.0, "b": 0.0}
+	if j := JaccardSim(none, none); j != 0 {
+		t.Error("Expected jaccard similarity of 0 without non-zero scores, got", j)
+	}
+}
+
+func TestEuclidean(t *testing.T) {
+	cases := []struct {
+		name     string
+		t1, t2   map[interface{}]float64
+		expected float64
+	}{
+		{
+			"identical",
+			map[interface{}]float64{"a": 5.0, "b": 4.0},
+			map[interface{}]float64{"a": 5.0, "b": 4.0},
+			1.0,
+		},
+		{
+			// d = sqrt(3^2 + 4^2) = 5
+			"3-4-5",
+			map[interface{}]float64{"a": 5.0, "b": 4.0},
+			map[interface{}]float64{"a": 2.0, "b": 0.0},
+			1.0 / 6.0,
+		},
+		{
+			// only "a" is shared, d = 1
+			"partial overlap",
+			map[interface{}]float64{"a": 3.0, "b": 1.0},
+			map[interface{}]float64{"a": 2.0, "c": 5.0},
+			0.5,
+		},
+		{
+			// d = sqrt(1 + 1 + 2^2) = sqrt(6)
+			"three keys",
+			map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 3.0},
+			map[interface{}]float64{"a": 2.0, "b": 3.0, "c": 1.0},
+			1.0 / (1.0 + math.Sqrt(6)),
+		},
+		{
+			"no overlap",
+			map[interface{}]float64{"a": 1.0},
+			map[interface{}]float64{"b": 1.0},
+			0,
+		},
+		{
+			"empty",
+			map[interface{}]float64{},
+			map[interface{}]float64{},
+			0,
+		},
+	}
+
+	for _, c := range cases {
+		if e := EuclideanSim(c.t1, c.t2); math.Abs(e-c.expected) > 1e-9 {
+			t.Errorf("%s: expected euclidean similarity of %v, got %v", c.name, c.expected, e)
+		}
+	}
+}
+
+func TestPearsonSim(t *testing.T) {
+	t1 := map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 3.0}
+	t2 := map[interface{}]float64{"a": 3.0, "b": 2.0, "c": 1.0}
+
+	if p := PearsonSim(t1, t1); math.Abs(p-1.0) > 1e-9 {
+		t.Error("Expected 1.0 for identical items, got", p)
+	}
+	if p := PearsonSim(t1, t2); math.Abs(p+1.0) > 1e-9 {
+		t.Error("Expected -1.0 for anti-correlated items, got", p)
+	}
+	if p := PearsonSim(t1, map[interface{}]float64{"a": 4.0, "d": 2.0}); p != 0 {
+		t.Error("Expected 0 for a single shared key, got", p)
+	}
+}
+
+func TestEuclideanMonotonic(t *testing.T) {
+	t1 := map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 3.0}
+	if e := EuclideanSim(t1, t1); e != 1.0 {
+		t.Error("Expected 1.0 for identical items, got", e)
+	}
+
+	last := 1.0
+	for d := 0.5; d <= 5.0; d += 0.5 {
+		t2 := map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 3.0 + d}
+		e := EuclideanSim(t1, t2)
+		if e >= last {
+			t.Errorf("Expected similarity to decrease with distance %v, got %v after %v", d, e, last)
+		}
+		last = e
+	}
+}
+
+func TestManhattanOutlier(t *testing.T) {
+	t1 := map[interface{}]float64{"a": 3.0, "b": 3.0, "c": 3.0, "d": 3.0}
+	// a single outlier rating
+	outlier := map[interface{}]float64{"a": 3.0, "b": 3.0, "c": 3.0, "d": 0.0}
+	// small differences everywhere
+	spread := map[interface{}]float64{"a": 4.0, "b": 2.0, "c": 4.0, "d": 2.0}
+
+	if m := manhattanSim(t1, outlier); m != 0.25 {
+		t.Error("Expected manhattan similarity of 0.25, got", m)
+	}
+	if m := manhattanSim(t1, spread); m != 0.2 {
+		t.Error("Expected manhattan similarity of 0.2, got", m)
+	}
+	if EuclideanSim(t1, outlier) >= EuclideanSim(t1, spread) {
+		t.Error("Expected euclidean similarity to punish the outlier harder")
+	}
+
+	if m := manhattanSim(t1, map[interface{}]float64{"x": 3.0}); m != 0 {
+		t.Error("Expected 0 without shared keys, got", m)
+	}
+	extra := map[interface{}]float64{"a": 3.0, "b": 3.0, "c": 3.0, "d": 0.0, "x": 100.0}
+	if m := manhattanSim(t1, extra); m != 0.25 {
+		t.Error("Expected unshared keys to be ignored, got", m)
+	}
+}
+
+func TestTanimoto(t *testing.T) {
+	t1 := map[interface{}]float64{"a": 2.0, "b": 1.0}
+	t2 := map[interface{}]float64{"a": 1.0, "c": 3.0}
+
+	if s := tanimotoSim(t1, t1); s != 1.0 {
+		t.Error("Expected 1.0 for identical items, got", s)
+	}
+	if s := tanimotoSim(t1, map[interface{}]float64{"x": 1.0}); s != 0 {
+		t.Error("Expected 0 for disjoint items, got", s)
+	}
+	// 2 / (5 + 10 - 2)
+	if s := tanimotoSim(t1, t2); math.Abs(s-2.0/13.0) > 1e-9 {
+		t.Error("Expected 2/13 for partially overlapping items, got", s)
+	}
+	if s := tanimotoSim(map[interface{}]float64{}, map[interface{}]float64{}); s != 0 {
+		t.Error("Expected 0 for empty items, got", s)
+	}
+}
+
+func TestSpearman(t *testing.T) {
+	// same order, wildly different magnitudes
+	t1 := map[interface{}]float64{"a": 1.0, "b": 2.0, "c": 3.0, "d": 4.0}
+	t2 := map[interface{}]float64{"a": 0.1, "b": 50.0, "c": 51.0, "d": 1000.0}
+	if s := spearmanSim(t1, t2); math.Abs(s-1.0) > 1e-9 {
+		t.Error("Expected 1.0 for items agreeing on the order, got", s)
+	}
+
+	// ties get averaged ranks: t3 ranks 1.5, 1.5, 3, 4
+	t3 := map[interface{}]float64{"a": 2.0, "b": 2.0, "c": 3.0, "d": 5.0}
+	if s := spearmanSim(t1, t3); s <= 0.9 || s >= 1.0 {
+		t.Error("Expected a high but imperfect correlation with ties, got", s)
+	}
+
+	flat := map[interface{}]float64{"a": 3.0, "b": 3.0, "c": 3.0, "d": 3.0}
+	if s := spearmanSim(t1, flat); s != 0 {
+		t.Error("Expected 0 for an all-tied item, got", s)
+	}
+	if s := spearmanSim(t1, map[interface{}]float64{"a": 1.0, "b": 2.0}); s != 0 {
+		t.Error("Expected 0 for fewer than three shared keys, got", s)
+	}
+}
+
+func TestCosineAsymmetric(t *testing.T) {
+	small := map[interface{}]float64{"a": 3.0, "b": 4.0}
+	big := map[interface{}]float64{"a": 1.0, "c": 2.0, "d": 2.0}
+
+	// the norm of the first map covers all of its scores, the second one's
+	// only the shared ones
+	if c := cosineSim(small, big); math.Abs(c-3.0/5.0) > 1e-9 {
+		t.Error("Expected cosine similarity of 0.6, got", c)
+	}
+	if c := cosineSim(big, small); math.Abs(c-1.0/3.0) > 1e-9 {
+		t.Error("Expected cosine similarity of 1/3, got", c)
+	}
+
+	disjoint := map[interface{}]float64{"e": 1.0}
+	if c := cosineSim(big, disjoint); c != 0 {
+		t.Error("Expected 0 for disjoint maps, got", c)
+	}
+}
+
+func sparseVectors() (map[interface{}]float64, map[interface{}]float64) {
+	small := make(map[interface{}]float64)
+	for i := 0; i < 10; i++ {
+		small[i*1000] = float64(i%5 + 1)
+	}
+	big := make(map[interface{}]float64)
+	for i := 0; i < 10000; i++ {
+		big[i] = float64(i%5 + 1)
+	}
+
+	return small, big
+}
+
+func BenchmarkCosineSmallBig(b *testing.B) {
+	small, big := sparseVectors()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cosineSim(small, big)
+	}
+}
+
+func BenchmarkCosineBigSmall(b *testing.B) {
+	small, big := sparseVectors()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cosineSim(big, small)
+	}
+}
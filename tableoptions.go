@@ -0,0 +1,158 @@
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"time"
+)
+
+// An option configuring a table created by New.
+type Option func(*RegommendTable)
+
+// Returns a new table with the given name, configured by the given options.
+// Unlike Table, the table doesn't get registered with an engine, so it can't
+// be looked up by its name later on, see Engine.CreateTable.
+func New(name string, opts ...Option) *RegommendTable {
+	table := &RegommendTable{
+		id:    newTableID(),
+		name:  name,
+		items: make(map[interface{}]*RegommendItem),
+	}
+	for _, opt := range opts {
+		opt(table)
+	}
+
+	return table
+}
+
+// Configures the table's logger, see SetLogger.
+func WithLogger(logger Logger) Option {
+	return func(table *RegommendTable) {
+		table.SetLogger(logger)
+	}
+}
+
+// Enables logging diagnostics, see SetVerbose.
+func WithVerbose(verbose bool) Option {
+	return func(table *RegommendTable) {
+		table.SetVerbose(verbose)
+	}
+}
+
+// Selects the similarity metric, see SetMetric.
+func WithMetric(m Metric) Option {
+	return func(table *RegommendTable) {
+		table.SetMetric(m)
+	}
+}
+
+// Configures a custom similarity function, see SetSimilarityFunc.
+func WithSimilarityFunc(f func(t1, t2 map[interface{}]float64) float64) Option {
+	return func(table *RegommendTable) {
+		table.SetSimilarityFunc(f)
+	}
+}
+
+// Configures similarity shrinkage, see SetSimilarityShrinkage.
+func WithSimilarityShrinkage(lambda float64) Option {
+	return func(table *RegommendTable) {
+		table.SetSimilarityShrinkage(lambda)
+	}
+}
+
+// Configures the minimum overlap of neighbors, see SetMinOverlap.
+func WithMinOverlap(n int) Option {
+	return func(table *RegommendTable) {
+		table.SetMinOverlap(n)
+	}
+}
+
+// Selects how neighbors' scores get combined, see SetAggregation.
+func WithAggregation(a Aggregation) Option {
+	return func(table *RegommendTable) {
+		table.SetAggregation(a)
+	}
+}
+
+// Configures the number of goroutines used by RecommendBatch, see
+// SetWorkers.
+func WithWorkers(n int) Option {
+	return func(table *RegommendTable) {
+		table.SetWorkers(n)
+	}
+}
+
+// Enables the similarity cache, see SetSimilarityCache.
+func WithSimilarityCache(enabled bool) Option {
+	return func(table *RegommendTable) {
+		table.SetSimilarityCache(enabled)
+	}
+}
+
+// Configures the table-wide TTL, see SetTTL.
+func WithTTL(d time.Duration) Option {
+	return func(table *RegommendTable) {
+		table.SetTTL(d)
+	}
+}
+
+// Configures the TTL given to added items, see SetDefaultTTL.
+func WithDefaultTTL(d time.Duration) Option {
+	return func(table *RegommendTable) {
+		table.SetDefaultTTL(d)
+	}
+}
+
+// Configures how quickly scores lose weight, see SetDecay.
+func WithDecay(halfLife time.Duration) Option {
+	return func(table *RegommendTable) {
+		table.SetDecay(halfLife)
+	}
+}
+
+// Configures the data loader, see SetDataLoader.
+func WithDataLoader(f func(interface{}) *RegommendItem) Option {
+	return func(table *RegommendTable) {
+		table.SetDataLoader(f)
+	}
+}
+
+// Configures the added-item callback, see SetAddedItemCallback.
+func WithAddedItemCallback(f func(*RegommendItem)) Option {
+	return func(table *RegommendTable) {
+		table.SetAddedItemCallback(f)
+	}
+}
+
+// Configures the added-item filter, see SetAddedItemFilter.
+func WithAddedItemFilter(f func(*RegommendItem) bool) Option {
+	return func(table *RegommendTable) {
+		table.SetAddedItemFilter(f)
+	}
+}
+
+// Configures the delete callback, see SetAboutToDeleteItemCallback.
+func WithAboutToDeleteItemCallback(f func(*RegommendItem)) Option {
+	return func(table *RegommendTable) {
+		table.SetAboutToDeleteItemCallback(f)
+	}
+}
+
+// Configures the delete filter, see SetAboutToDeleteFilter.
+func WithAboutToDeleteFilter(f func(*RegommendItem) bool) Option {
+	return func(table *RegommendTable) {
+		table.SetAboutToDeleteFilter(f)
+	}
+}
+
+// Configures the expired-item callback, see SetExpiredItemCallback.
+func WithExpiredItemCallback(f func(*RegommendItem)) Option {
+	return func(table *RegommendTable) {
+		table.SetExpiredItemCallback(f)
+	}
+}
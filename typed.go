@@ -0,0 +1,147 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+// A type-safe wrapper around a RegommendTable, for tables whose keys and
+// data keys all are of type K.
+type TypedTable[K comparable] struct {
+	table *RegommendTable
+}
+
+// A key of a TypedTable and its similarity to the key a query was made for.
+type TypedDistancePair[K comparable] struct {
+	Key      K
+	Distance float64
+}
+
+// A recommended data key of a TypedTable and its score.
+type TypedRecommendation[K comparable] struct {
+	Key   K
+	Score float64
+	// The score before normalizing it, see Normalize.
+	Raw float64
+	// How much of the evidence backs the recommendation, see
+	// Recommendation.Confidence.
+	Confidence float64
+	// How many neighbors the score is based on.
+	Contributors int
+}
+
+// Returns a new typed table with the given name, see New.
+func NewTyped[K comparable](name string, opts ...Option) *TypedTable[K] {
+	return Typed[K](New(name, opts...))
+}
+
+// Wraps the given table, e.g. one returned by Table. The table must only
+// contain keys and data keys of type K.
+func Typed[K comparable](table *RegommendTable) *TypedTable[K] {
+	return &TypedTable[K]{
+		table: table,
+	}
+}
+
+// Returns the wrapped table.
+func (t *TypedTable[K]) Untyped() *RegommendTable {
+	return t.table
+}
+
+// Returns how many items are currently stored in the table.
+func (t *TypedTable[K]) Count() int {
+	return t.table.Count()
+}
+
+// Adds the given key and data to the table, see RegommendTable.Add.
+func (t *TypedTable[K]) Add(key K, data map[K]float64) {
+	t.table.Add(key, untypedData(data))
+}
+
+// Merges data into the existing item with the given key, see
+// RegommendTable.Update.
+func (t *TypedTable[K]) Update(key K, data map[K]float64) error {
+	_, err := t.table.Update(key, untypedData(data))
+	return err
+}
+
+// Deletes the item with the given key from the table.
+func (t *TypedTable[K]) Delete(key K) error {
+	_, err := t.table.Delete(key)
+	return err
+}
+
+// Returns whether an item with the given key exists in the table.
+func (t *TypedTable[K]) Exists(key K) bool {
+	return t.table.Exists(key)
+}
+
+// Returns a copy of the data of the item with the given key, see
+// RegommendTable.Value.
+func (t *TypedTable[K]) Value(key K) (map[K]float64, error) {
+	item, err := t.table.Value(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := item.Data()
+	typed := make(map[K]float64, len(data))
+	for k, v := range data {
+		typed[k.(K)] = v
+	}
+	return typed, nil
+}
+
+// Returns the neighbors of the item with the given key, see
+// RegommendTable.Neighbors.
+func (t *TypedTable[K]) Neighbors(key K) ([]TypedDistancePair[K], error) {
+	return t.NeighborsN(key, 0)
+}
+
+// Returns the n closest neighbors of the item with the given key, see
+// RegommendTable.NeighborsN.
+func (t *TypedTable[K]) NeighborsN(key K, n int) ([]TypedDistancePair[K], error) {
+	dists, err := t.table.NeighborsN(key, n)
+	typed := make([]TypedDistancePair[K], len(dists))
+	for i, v := range dists {
+		typed[i] = TypedDistancePair[K]{
+			Key:      v.Key.(K),
+			Distance: v.Distance,
+		}
+	}
+
+	return typed, err
+}
+
+// Returns the n best recommendations for the item with the given key, see
+// RegommendTable.Recommend.
+func (t *TypedTable[K]) Recommend(key K, n int, opts ...RecommendOption) ([]TypedRecommendation[K], error) {
+	recs, err := t.table.Recommend(key, n, opts...)
+	typed := make([]TypedRecommendation[K], len(recs))
+	for i, v := range recs {
+		typed[i] = TypedRecommendation[K]{
+			Key:          v.Key.(K),
+			Score:        v.Score,
+			Raw:          v.Raw,
+			Confidence:   v.Confidence,
+			Contributors: v.Contributors,
+		}
+	}
+
+	return typed, err
+}
+
+// Converts typed data to the data stored in items.
+func untypedData[K comparable](data map[K]float64) map[interface{}]float64 {
+	untyped := make(map[interface{}]float64, len(data))
+	for k, v := range data {
+		untyped[k] = v
+	}
+
+	return untyped
+}
@@ -0,0 +1,85 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Simple recommendation engine
+ *     Copyright (c) 2014, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package regommend
+
+import (
+	"testing"
+)
+
+func TestTypedTableString(t *testing.T) {
+	books := NewTyped[string]("typedstring")
+	untyped := Table("typedstringuntyped")
+
+	ratings := map[string]map[string]float64{
+		"Chris": {"1984": 5.0, "Robinson Crusoe": 4.0, "Moby-Dick": 3.0},
+		"Jay":   {"1984": 5.0, "Robinson Crusoe": 4.0, "Gulliver's Travels": 4.5},
+		"Mary":  {"1984": 4.0, "Robinson Crusoe": 3.0, "Gulliver's Travels": 4.5},
+		"Jack":  {"1984": 3.0, "Robinson Crusoe": 1.0},
+	}
+	for key, data := range ratings {
+		books.Add(key, data)
+		untyped.Add(key, untypedData(data))
+	}
+
+	nbs, err := books.Neighbors("Chris")
+	if err != nil {
+		t.Fatal("Error retrieving neighbors", err)
+	}
+	expected, _ := untyped.Neighbors("Chris")
+	if len(nbs) != len(expected) {
+		t.Fatal("Expected", len(expected), "neighbors, got", len(nbs))
+	}
+	for i, v := range nbs {
+		if v.Key != expected[i].Key || v.Distance != expected[i].Distance {
+			t.Error("Expected typed neighbors to match, got", v, expected[i])
+		}
+	}
+
+	recs, _ := books.Recommend("Chris", 1)
+	if len(recs) != 1 || recs[0].Key != "Gulliver's Travels" {
+		t.Error("Unexpected typed recommendations", recs)
+	}
+
+	data, err := books.Value("Jack")
+	if err != nil || data["1984"] != 3.0 {
+		t.Error("Expected typed data, got", data, err)
+	}
+	if _, err := books.Value("Tom"); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestTypedTableInt(t *testing.T) {
+	table := Typed[int](Table("typedint"))
+	untyped := benchmarkTable("typedintuntyped", 100)
+	untyped.Foreach(func(key interface{}, item *RegommendItem) {
+		data := make(map[int]float64)
+		for k, v := range item.Data() {
+			data[k.(int)] = v
+		}
+		table.Add(key.(int), data)
+	})
+
+	nbs, _ := table.NeighborsN(0, 10)
+	expected, _ := untyped.NeighborsN(0, 10)
+	if len(nbs) != 10 {
+		t.Fatal("Expected 10 neighbors, got", len(nbs))
+	}
+	for i, v := range nbs {
+		if v.Key != expected[i].Key || v.Distance != expected[i].Distance {
+			t.Error("Expected typed neighbors to match, got", v, expected[i])
+		}
+	}
+
+	if table.Untyped() != Table("typedint") || table.Count() != 100 {
+		t.Error("Expected typed table to wrap the registered one")
+	}
+}